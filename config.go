@@ -1,10 +1,21 @@
 package postgresexporter
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/destrex271/postgresexporter/internal"
 	"github.com/destrex271/postgresexporter/internal/db"
+	"github.com/jackc/pgx/v5"
+	"go.opentelemetry.io/collector/component"
+	"go.opentelemetry.io/collector/config/configretry"
+	"go.opentelemetry.io/collector/confmap"
 	"go.opentelemetry.io/collector/exporter/exporterhelper"
 )
 
@@ -12,26 +23,44 @@ type Config struct {
 	// Database config
 	DatabaseConfig  DatabaseConfig               `mapstructure:"database"`
 
-	// Decided to create separate tables for each metric to provide better performance.
-	// But you can define DatabaseConfig.Schema in which to create it.
-	// Metrics table name
-	// MetricsTableName string                       `mapstructure:"metrics_table_name"`
+	// Metrics are stored in a table per metric by default, or in a table per metric type,
+	// see MetricsConfig.Layout. Both are created in DatabaseConfig.Schema.
 
 	// Logs table name
 	LogsTableName   string                       `mapstructure:"logs_table_name"`
 	// Traces table name
 	TracesTableName string                       `mapstructure:"traces_table_name"`
 
+	// Logs specific settings
+	Logs            LogsConfig                   `mapstructure:"logs"`
+	// Traces specific settings
+	Traces          TracesConfig                 `mapstructure:"traces"`
+	// Metrics specific settings
+	Metrics         MetricsConfig                `mapstructure:"metrics"`
+
 	// Pre-create the schema and tables if true. Default - true.
 	CreateSchema    bool                         `mapstructure:"create_schema"`
+	// How often background maintenance, e.g. creating upcoming partitions, runs. Default - 10m
+	MaintenanceInterval time.Duration            `mapstructure:"maintenance_interval"`
+	// Also store timestamps as BIGINT nanoseconds since the Unix epoch, "TimestampUnixNano" in logs and traces
+	// and "start_time_unix_nano" and "time_unix_nano" in metric tables. TIMESTAMPTZ columns keep microseconds
+	// only. Default - false
+	TimestampUnixNano   bool                     `mapstructure:"timestamp_unix_nano"`
 
 	// Timeout
 	TimeoutSettings exporterhelper.TimeoutConfig `mapstructure:",squash"`
 	// Sending queue settings
 	QueueSettings   exporterhelper.QueueConfig   `mapstructure:"sending_queue"`
+	// Retry settings. Only failures that may succeed on another attempt are retried,
+	// e.g. lost connections or deadlocks, and for metrics only the metrics that failed
+	BackOffConfig   configretry.BackOffConfig    `mapstructure:"retry_on_failure"`
 }
 
 type DatabaseConfig struct {
+	// pgx connection string, a URL or keyword/value pairs, replacing the connection fields below, e.g.
+	// 'postgres://db1:5432,db2:5432/otel?target_session_attrs=read-write'. Settings missing from it
+	// are read from the PG* environment variables
+	DSN      string             `mapstructure:"dsn"`
 	// Type. Can be 'postgresql', 'timescaledb', 'paradedb' etc.
 	// The structure of data may be different for each type
 	Type     internal.DBType    `mapstructure:"type"`
@@ -43,12 +72,95 @@ type DatabaseConfig struct {
 	Username string             `mapstructure:"username"`
 	// Password
 	Password string             `mapstructure:"password"`
+	// File holding the password, read for every new connection so rotated secrets are picked up.
+	// Replaces Password
+	PasswordFile     string        `mapstructure:"password_file"`
+	// Extension implementing PasswordProvider, asked for the password of every new connection.
+	// Replaces Password
+	PasswordProvider *component.ID `mapstructure:"password_provider"`
 	// Database name. Default - otel
 	Database string             `mapstructure:"database"`
 	// Schema name. Default - otel
 	Schema   string             `mapstructure:"schema"`
-	// SSL mode. Default - disabled
+	// SSL mode. Can be 'disable', 'allow', 'prefer', 'require', 'verify-ca' or 'verify-full'. Default - disable
 	SSLmode  string             `mapstructure:"sslmode"`
+	// CA, client certificate, server name and TLS version settings, used unless sslmode is 'disable'
+	TLS      db.TLSConfig       `mapstructure:"tls"`
+	// Connection pool shared by the logs, traces and metrics exporters of the component
+	Pool     PoolConfig         `mapstructure:"pool"`
+}
+
+type PoolConfig struct {
+	// Maximum number of open connections. Zero means unlimited. Default - 0
+	MaxOpenConns    int           `mapstructure:"max_open_conns"`
+	// Maximum number of idle connections kept open. Zero keeps none. Default - 2
+	MaxIdleConns    int           `mapstructure:"max_idle_conns"`
+	// Connections are closed once they've been open this long. Zero keeps them. Default - 0
+	ConnMaxLifetime time.Duration `mapstructure:"conn_max_lifetime"`
+	// Connections are closed once they've been idle this long. Zero keeps them. Default - 0
+	ConnMaxIdleTime time.Duration `mapstructure:"conn_max_idle_time"`
+}
+
+type LogsConfig struct {
+	// Write batches with COPY FROM STDIN instead of one INSERT per record. Default - false
+	UseCopy      bool                        `mapstructure:"use_copy"`
+	// Partition the logs table by "Timestamp". Ignored for TimescaleDB, where it's a hypertable
+	Partitioning internal.PartitioningConfig `mapstructure:"partitioning"`
+	// Records older than this are removed in the background. Zero keeps everything. Default - 0
+	Retention    time.Duration               `mapstructure:"retention"`
+	// Hypertable settings of the logs table
+	TimescaleDB  internal.TimescaleDBConfig  `mapstructure:"timescaledb"`
+	// Search index settings of the logs table
+	ParadeDB     internal.ParadeDBConfig     `mapstructure:"paradedb"`
+}
+
+type TracesConfig struct {
+	// Write batches with COPY FROM STDIN instead of one INSERT per span. Default - false
+	UseCopy      bool                        `mapstructure:"use_copy"`
+	// What to do with a span that is already stored, e.g. when a batch is retried.
+	// Can be 'error', 'do_nothing' or 'update'. Default - do_nothing.
+	// Logs have no such setting, records are keyed by a generated "LogId" and never collide
+	OnConflict   internal.ConflictAction     `mapstructure:"on_conflict"`
+	// Partition the traces table by "Timestamp". Ignored for TimescaleDB, where it's a hypertable
+	Partitioning internal.PartitioningConfig `mapstructure:"partitioning"`
+	// Spans older than this are removed in the background. Zero keeps everything. Default - 0
+	Retention    time.Duration               `mapstructure:"retention"`
+	// Hypertable settings of the traces table
+	TimescaleDB  internal.TimescaleDBConfig  `mapstructure:"timescaledb"`
+}
+
+type MetricsConfig struct {
+	// Write data points with COPY FROM STDIN instead of one INSERT per data point. Default - false
+	UseCopy      bool                        `mapstructure:"use_copy"`
+	// Partition metric tables by timestamp. Only used with the 'postgresql' database type,
+	// TimescaleDB tables are hypertables already
+	Partitioning internal.PartitioningConfig `mapstructure:"partitioning"`
+	// Data points older than this are removed in the background. Zero keeps everything. Default - 0
+	Retention       time.Duration                `mapstructure:"retention"`
+	// Retention of the tables of a metric type, overriding Retention
+	RetentionByType internal.MetricTypeRetention `mapstructure:"retention_by_type"`
+	// Table layout. Can be 'table_per_metric', a table named after each metric, or 'table_per_type',
+	// one table per metric type like otel_metrics_gauge with a "name" column. Default - table_per_metric
+	Layout                   internal.MetricsLayout     `mapstructure:"layout"`
+	// How data point attributes are stored. Can be 'columns', one column per attribute key,
+	// or 'jsonb', a single "attributes" column. Default - columns
+	AttributesStorage        internal.AttributesStorage `mapstructure:"attributes_storage"`
+	// Create a GIN index on the "attributes" column of new tables with 'jsonb' storage. Default - false
+	AttributesGINIndex       bool                       `mapstructure:"attributes_gin_index"`
+	// Maximum number of attribute columns of a metric table. Attributes without a column
+	// are stored in "extra_attributes". Default - 20
+	AttributeColumns         int            `mapstructure:"attribute_columns"`
+	// Attribute columns limit by metric name, overriding AttributeColumns
+	AttributeColumnsByMetric map[string]int `mapstructure:"attribute_columns_by_metric"`
+	// Also write exemplars to the otel_metrics_exemplars table, indexed by trace id. The table is created
+	// on startup with CreateSchema, otherwise it must exist already. Default - false
+	ExemplarsTable           bool           `mapstructure:"exemplars_table"`
+	// Store histogram buckets and summary quantiles as BIGINT[] and DOUBLE PRECISION[] instead of JSONB.
+	// Applies to tables created afterwards. Default - false
+	NativeArrays             bool           `mapstructure:"native_arrays"`
+	// Temporality sums are stored with. Can be 'as_received', 'cumulative' or 'delta'.
+	// Converting keeps the state of every series in the exporter. Default - as_received
+	SumTemporality           internal.SumTemporality `mapstructure:"sum_temporality"`
 }
 
 // Should create schema
@@ -56,14 +168,231 @@ func (cfg *Config) shouldCreateSchema() bool {
 	return cfg.CreateSchema
 }
 
-// Build database connection
-func (cfg *Config) buildDB() (*sql.DB, error) {
+// Schema qualified name of the logs table
+func (cfg *Config) logsTable() pgx.Identifier {
+	return pgx.Identifier{cfg.DatabaseConfig.Schema, cfg.LogsTableName}
+}
+
+// Native partitioning only applies to plain PostgreSQL, TimescaleDB partitions hypertables itself
+func (cfg *Config) nativePartitioning(partitioning internal.PartitioningConfig) internal.PartitioningConfig {
+	if cfg.DatabaseConfig.Type == internal.DBTypeTimescaleDB {
+		return internal.PartitioningConfig{}
+	}
+	return partitioning
+}
+
+// Schema qualified name of the traces table
+func (cfg *Config) tracesTable() pgx.Identifier {
+	return pgx.Identifier{cfg.DatabaseConfig.Schema, cfg.TracesTableName}
+}
+
+// Schema qualified name of a table derived from the traces table, e.g. "otel"."oteltraces_trace_id_ts"
+func (cfg *Config) tracesTableWithSuffix(suffix string) pgx.Identifier {
+	return pgx.Identifier{cfg.DatabaseConfig.Schema, cfg.TracesTableName + suffix}
+}
+
+// PostgreSQL truncates longer identifiers, so the tables wouldn't be found under the configured name
+const maxIdentifierLength = 63
+
+var sslModes = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+
+var errDSNConflict = errors.New("database.dsn can't be combined with database host, port, username, password, database or sslmode")
+
+// Fields replaced by DSN
+var dsnConflictKeys = []string{"host", "port", "username", "password", "database", "sslmode"}
+
+// Unmarshal rejects the fields replaced by dsn when they're set next to it, even to their default values,
+// which Validate can't tell from unset ones
+func (dbcfg *DatabaseConfig) Unmarshal(conf *confmap.Conf) error {
+	if conf.IsSet("dsn") {
+		for _, key := range dsnConflictKeys {
+			if conf.IsSet(key) {
+				return errDSNConflict
+			}
+		}
+	}
+
+	return conf.Unmarshal(dbcfg)
+}
+
+// Validate checks the configuration
+func (cfg *Config) Validate() error {
+	var errs error
 	dbcfg := cfg.DatabaseConfig
 
-	conn, err := db.Open(db.URL(dbcfg.Host, dbcfg.Port, dbcfg.Username, dbcfg.Password, dbcfg.Database, dbcfg.SSLmode))
+	if dbcfg.DSN != "" {
+		defaults := createDefaultConfig().(*Config).DatabaseConfig
+		if dbcfg.Host != defaults.Host || dbcfg.Port != defaults.Port || dbcfg.Username != defaults.Username ||
+			dbcfg.Password != defaults.Password || dbcfg.Database != defaults.Database || dbcfg.SSLmode != defaults.SSLmode {
+			errs = errors.Join(errs, errDSNConflict)
+		}
+	} else {
+		if dbcfg.Port < 1 || dbcfg.Port > 65535 {
+			errs = errors.Join(errs, fmt.Errorf("database.port must be between 1 and 65535, got %d", dbcfg.Port))
+		}
+		if !slices.Contains(sslModes, dbcfg.SSLmode) {
+			errs = errors.Join(errs, fmt.Errorf("unknown database.sslmode %q, expected one of %s", dbcfg.SSLmode, strings.Join(sslModes, ", ")))
+		}
+	}
+
+	switch dbcfg.Type {
+	case internal.DBTypePostgreSQL, internal.DBTypeTimescaleDB, internal.DBTypeParadeDB:
+	default:
+		errs = errors.Join(errs, fmt.Errorf("unknown database.type %q, expected postgresql, timescaledb or paradedb", dbcfg.Type))
+	}
+
+	errs = errors.Join(errs, validateIdentifier("database.schema", dbcfg.Schema))
+	if strings.HasPrefix(dbcfg.Schema, "pg_") {
+		errs = errors.Join(errs, fmt.Errorf("database.schema %q is invalid, the pg_ prefix is reserved for system schemas", dbcfg.Schema))
+	}
+	errs = errors.Join(errs, validateIdentifier("logs_table_name", cfg.LogsTableName))
+	errs = errors.Join(errs, validateIdentifier("traces_table_name", cfg.TracesTableName))
+
+	if dbcfg.PasswordFile != "" && dbcfg.PasswordProvider != nil {
+		errs = errors.Join(errs, errors.New("database.password_file and database.password_provider can't be combined"))
+	}
+
+	if dbcfg.Pool.MaxOpenConns < 0 || dbcfg.Pool.MaxIdleConns < 0 || dbcfg.Pool.ConnMaxLifetime < 0 || dbcfg.Pool.ConnMaxIdleTime < 0 {
+		errs = errors.Join(errs, errors.New("database.pool settings can't be negative"))
+	}
+
+	switch cfg.Traces.OnConflict {
+	case internal.ConflictActionError, internal.ConflictActionDoNothing, internal.ConflictActionUpdate:
+	default:
+		errs = errors.Join(errs, fmt.Errorf("unknown traces.on_conflict %q, expected error, do_nothing or update", cfg.Traces.OnConflict))
+	}
+
+	switch cfg.Metrics.Layout {
+	case internal.MetricsLayoutTablePerMetric, internal.MetricsLayoutTablePerType:
+	default:
+		errs = errors.Join(errs, fmt.Errorf("unknown metrics.layout %q, expected table_per_metric or table_per_type", cfg.Metrics.Layout))
+	}
+
+	switch cfg.Metrics.AttributesStorage {
+	case internal.AttributesStorageColumns, internal.AttributesStorageJSONB:
+	default:
+		errs = errors.Join(errs, fmt.Errorf("unknown metrics.attributes_storage %q, expected columns or jsonb", cfg.Metrics.AttributesStorage))
+	}
+
+	switch cfg.Metrics.SumTemporality {
+	case internal.SumTemporalityAsReceived, internal.SumTemporalityCumulative, internal.SumTemporalityDelta:
+	default:
+		errs = errors.Join(errs, fmt.Errorf("unknown metrics.sum_temporality %q, expected as_received, cumulative or delta", cfg.Metrics.SumTemporality))
+	}
+
+	for _, signal := range []struct {
+		name         string
+		partitioning internal.PartitioningConfig
+		retention    time.Duration
+	}{
+		{name: "logs", partitioning: cfg.Logs.Partitioning, retention: cfg.Logs.Retention},
+		{name: "traces", partitioning: cfg.Traces.Partitioning, retention: cfg.Traces.Retention},
+		{name: "metrics", partitioning: cfg.Metrics.Partitioning, retention: cfg.Metrics.Retention},
+	} {
+		switch signal.partitioning.Interval {
+		case internal.PartitionIntervalNone, internal.PartitionIntervalHourly, internal.PartitionIntervalDaily:
+		default:
+			errs = errors.Join(errs, fmt.Errorf("unknown %s.partitioning.interval %q, expected hourly or daily", signal.name, signal.partitioning.Interval))
+		}
+		if signal.partitioning.Premake < 0 {
+			errs = errors.Join(errs, fmt.Errorf("%s.partitioning.premake can't be negative, got %d", signal.name, signal.partitioning.Premake))
+		}
+		if signal.retention < 0 {
+			errs = errors.Join(errs, fmt.Errorf("%s.retention can't be negative, got %s", signal.name, signal.retention))
+		}
+	}
+
+	for _, hypertable := range []struct {
+		name        string
+		timescaleDB internal.TimescaleDBConfig
+	}{
+		{name: "logs", timescaleDB: cfg.Logs.TimescaleDB},
+		{name: "traces", timescaleDB: cfg.Traces.TimescaleDB},
+	} {
+		if hypertable.timescaleDB.ChunkInterval <= 0 {
+			errs = errors.Join(errs, fmt.Errorf("%s.timescaledb.chunk_interval must be positive, got %s", hypertable.name, hypertable.timescaleDB.ChunkInterval))
+		}
+		if hypertable.timescaleDB.CompressAfter < 0 {
+			errs = errors.Join(errs, fmt.Errorf("%s.timescaledb.compress_after can't be negative, got %s", hypertable.name, hypertable.timescaleDB.CompressAfter))
+		}
+	}
+
+	retentionByType := cfg.Metrics.RetentionByType
+	if retentionByType.Gauge < 0 || retentionByType.Sum < 0 || retentionByType.Histogram < 0 ||
+		retentionByType.ExponentialHistogram < 0 || retentionByType.Summary < 0 {
+		errs = errors.Join(errs, errors.New("metrics.retention_by_type can't be negative"))
+	}
+
+	if cfg.Metrics.AttributeColumns <= 0 {
+		errs = errors.Join(errs, fmt.Errorf("metrics.attribute_columns must be positive, got %d", cfg.Metrics.AttributeColumns))
+	}
+	for _, name := range slices.Sorted(maps.Keys(cfg.Metrics.AttributeColumnsByMetric)) {
+		if columns := cfg.Metrics.AttributeColumnsByMetric[name]; columns <= 0 {
+			errs = errors.Join(errs, fmt.Errorf("metrics.attribute_columns_by_metric of %q must be positive, got %d", name, columns))
+		}
+	}
+
+	if _, err := logsSearchColumns(cfg); err != nil {
+		errs = errors.Join(errs, fmt.Errorf("logs.paradedb.indexed_attributes: %w", err))
+	}
+
+	// A zero interval would silently disable partition maintenance and retention
+	if cfg.MaintenanceInterval <= 0 {
+		errs = errors.Join(errs, fmt.Errorf("maintenance_interval must be positive, got %s", cfg.MaintenanceInterval))
+	}
+
+	return errs
+}
+
+// Names are always quoted in SQL, so any name PostgreSQL stores as given is accepted
+func validateIdentifier(setting, name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("%s can't be empty", setting)
+	case len(name) > maxIdentifierLength:
+		return fmt.Errorf("%s %q is longer than %d bytes", setting, name, maxIdentifierLength)
+	case strings.ContainsRune(name, 0):
+		return fmt.Errorf("%s %q contains a NUL byte", setting, name)
+	}
+
+	return nil
+}
+
+// Connection string of the database, the DSN if it's set
+func (dbcfg DatabaseConfig) connString() string {
+	if dbcfg.DSN != "" {
+		return dbcfg.DSN
+	}
+	return db.URL(dbcfg.Host, dbcfg.Port, dbcfg.Username, dbcfg.Password, dbcfg.Database, dbcfg.SSLmode)
+}
+
+// Build database connection pool and check that the database is reachable
+func (cfg *Config) buildDB(ctx context.Context, host component.Host) (*sql.DB, error) {
+	dbcfg := cfg.DatabaseConfig
+
+	password, err := dbcfg.passwordFunc(host)
 	if err != nil {
 		return nil, err
 	}
 
+	conn, err := db.Open(dbcfg.connString(), dbcfg.TLS, password)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetMaxOpenConns(dbcfg.Pool.MaxOpenConns)
+	conn.SetMaxIdleConns(dbcfg.Pool.MaxIdleConns)
+	conn.SetConnMaxLifetime(dbcfg.Pool.ConnMaxLifetime)
+	conn.SetConnMaxIdleTime(dbcfg.Pool.ConnMaxIdleTime)
+
+	if err := conn.PingContext(ctx); err != nil {
+		_ = conn.Close()
+		// The error names the hosts tried, and a DSN may hold a password
+		if dbcfg.DSN != "" {
+			return nil, fmt.Errorf("failed connecting to postgres: %w", err)
+		}
+		return nil, fmt.Errorf("failed connecting to postgres at %s:%d/%s: %w", dbcfg.Host, dbcfg.Port, dbcfg.Database, err)
+	}
+
 	return conn, nil
 }
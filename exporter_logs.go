@@ -6,8 +6,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"slices"
+	"strings"
 	"time"
 
+	"github.com/destrex271/postgresexporter/internal"
+	"github.com/destrex271/postgresexporter/internal/db"
 	"github.com/destrex271/postgresexporter/internal/traceutil"
 	"go.opentelemetry.io/collector/component"
 	"go.opentelemetry.io/collector/pdata/pcommon"
@@ -17,34 +21,84 @@ import (
 )
 
 type logsExporter struct {
-	client    *sql.DB
-	insertSQL string
-	logger    *zap.Logger
-	cfg       *Config
+	client     *sql.DB
+	insertSQL  string
+	columns    []string
+	logger     *zap.Logger
+	cfg        *Config
+	maintainer *internal.Maintainer
 }
 
 func newLogsExporter(logger *zap.Logger, cfg *Config) (*logsExporter, error) {
-	client, err := cfg.buildDB()
-	if err != nil {
-		return nil, err
-	}
-
 	return &logsExporter{
-		client:    client,
 		insertSQL: renderInsertLogsSQL(cfg),
+		columns:   logsInsertColumns(cfg),
 		logger:    logger,
 		cfg:       cfg,
 	}, nil
 }
 
-func (e *logsExporter) start(ctx context.Context, _ component.Host) error {
+func (e *logsExporter) start(ctx context.Context, host component.Host) error {
 	log.Println("Starting LOG EXPORTER")
-	return createLogsTable(ctx, e.cfg, e.client)
+	client, err := pools.acquire(ctx, e.cfg, host)
+	if err != nil {
+		return err
+	}
+	e.client = client
+
+	// Without create_schema the tables are managed elsewhere, but a schema of a newer exporter is still refused
+	err = internal.CheckSchemaVersion(ctx, e.client, e.cfg.DatabaseConfig.Schema, logsMigrationTarget(e.cfg), logsMigrations(e.cfg, e.logger))
+	if err != nil {
+		return fmt.Errorf("check logs schema version: %w", err)
+	}
+
+	if err := checkLegacyTables(ctx, e.client, e.cfg.DatabaseConfig.Schema, logsRelations(e.cfg)); err != nil {
+		return err
+	}
+
+	if e.cfg.shouldCreateSchema() {
+		if err := internal.CreateSchema(ctx, e.client, e.cfg.DatabaseConfig.Schema); err != nil {
+			return err
+		}
+
+		if err := createLogsTable(ctx, e.cfg, e.client, e.logger); err != nil {
+			return err
+		}
+
+		switch e.cfg.DatabaseConfig.Type {
+		case internal.DBTypeTimescaleDB:
+			err := internal.SetupHypertable(ctx, e.client, e.cfg.DatabaseConfig.Schema, e.cfg.LogsTableName,
+				"Timestamp", "ServiceName", e.cfg.Logs.TimescaleDB)
+			if err != nil {
+				return err
+			}
+		case internal.DBTypeParadeDB:
+			columns, err := logsSearchColumns(e.cfg)
+			if err != nil {
+				return err
+			}
+			err = internal.CreateBM25Index(ctx, e.client, e.cfg.DatabaseConfig.Schema, e.cfg.LogsTableName, "LogId", columns)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	maintainer, err := startMaintenance(ctx, e.client, e.logger, e.cfg, e.cfg.LogsTableName, e.cfg.nativePartitioning(e.cfg.Logs.Partitioning), e.cfg.Logs.Retention)
+	if err != nil {
+		return err
+	}
+	e.maintainer = maintainer
+
+	return nil
 }
 
 func (e *logsExporter) shutdown(_ context.Context) error {
+	if e.maintainer != nil {
+		e.maintainer.Shutdown()
+	}
 	if e.client != nil {
-		return e.client.Close()
+		return pools.release(e.cfg)
 	}
 	return nil
 }
@@ -52,96 +106,228 @@ func (e *logsExporter) shutdown(_ context.Context) error {
 func (e *logsExporter) pushLogsData(ctx context.Context, ld plog.Logs) error {
 	log.Println("[INFO]: Pushing logs --> ", ld)
 	start := time.Now()
-	err := doWithTx(ctx, e.client, func(tx *sql.Tx) error {
-		statement, err := tx.PrepareContext(ctx, e.insertSQL)
-		if err != nil {
-			return fmt.Errorf("PrepareContext:%w", err)
-		}
-		defer func() {
-			_ = statement.Close()
-		}()
-		var serviceName string
-
-		for i := 0; i < ld.ResourceLogs().Len(); i++ {
-			logs := ld.ResourceLogs().At(i)
-			res := logs.Resource()
-			resURL := logs.SchemaUrl()
-			resAttr := attributesToMap(res.Attributes())
-			if v, ok := res.Attributes().Get(conventions.AttributeServiceName); ok {
-				serviceName = v.Str()
-			}
+	rows := logsToRows(ld, e.cfg.TimestampUnixNano)
+
+	var err error
+	if e.cfg.Logs.UseCopy {
+		_, err = db.CopyFrom(ctx, e.client, e.cfg.logsTable(), e.columns, rows)
+	} else {
+		err = insertRows(ctx, e.client, e.insertSQL, rows)
+	}
 
-			for j := 0; j < logs.ScopeLogs().Len(); j++ {
-				rs := logs.ScopeLogs().At(j).LogRecords()
-				scopeURL := logs.ScopeLogs().At(j).SchemaUrl()
-				scopeName := logs.ScopeLogs().At(j).Scope().Name()
-				scopeVersion := logs.ScopeLogs().At(j).Scope().Version()
-				scopeAttr := attributesToMap(logs.ScopeLogs().At(j).Scope().Attributes())
-
-				for k := 0; k < rs.Len(); k++ {
-					r := rs.At(k)
-
-					timestamp := r.Timestamp()
-					if timestamp == 0 {
-						timestamp = r.ObservedTimestamp()
-					}
-
-					logAttr := attributesToMap(r.Attributes())
-					_, err = statement.ExecContext(ctx,
-						timestamp.AsTime(),
-						traceutil.TraceIDToHexOrEmptyString(r.TraceID()),
-						traceutil.SpanIDToHexOrEmptyString(r.SpanID()),
-						uint32(r.Flags()),
-						r.SeverityText(),
-						int32(r.SeverityNumber()),
-						serviceName,
-						r.Body().AsString(),
-						resURL,
-						resAttr,
-						scopeURL,
-						scopeName,
-						scopeVersion,
-						scopeAttr,
-						logAttr,
-					)
-					if err != nil {
-						return fmt.Errorf("ExecContext:%w", err)
-					}
-				}
-			}
-		}
-		return nil
-	})
 	duration := time.Since(start)
 	e.logger.Debug("insert logs", zap.Int("records", ld.LogRecordCount()),
 		zap.String("cost", duration.String()))
 	log.Println("Pushed logs.", err)
-	return err
+	return internal.ClassifyError(err)
+}
+
+// Flattens log records into rows ordered as logsColumns, followed by the unix nano timestamp if enabled
+func logsToRows(ld plog.Logs, unixNano bool) [][]any {
+	rows := make([][]any, 0, ld.LogRecordCount())
+	var serviceName string
+
+	for i := 0; i < ld.ResourceLogs().Len(); i++ {
+		logs := ld.ResourceLogs().At(i)
+		res := logs.Resource()
+		resURL := logs.SchemaUrl()
+		resAttr := attributesToJSON(res.Attributes())
+		if v, ok := res.Attributes().Get(conventions.AttributeServiceName); ok {
+			serviceName = v.Str()
+		}
+
+		for j := 0; j < logs.ScopeLogs().Len(); j++ {
+			rs := logs.ScopeLogs().At(j).LogRecords()
+			scopeURL := logs.ScopeLogs().At(j).SchemaUrl()
+			scopeName := logs.ScopeLogs().At(j).Scope().Name()
+			scopeVersion := logs.ScopeLogs().At(j).Scope().Version()
+			scopeAttr := attributesToJSON(logs.ScopeLogs().At(j).Scope().Attributes())
+
+			for k := 0; k < rs.Len(); k++ {
+				r := rs.At(k)
+
+				timestamp := r.Timestamp()
+				if timestamp == 0 {
+					timestamp = r.ObservedTimestamp()
+				}
+
+				logAttr := attributesToJSON(r.Attributes())
+				row := []any{
+					timestamp.AsTime(),
+					traceutil.TraceIDToHexOrEmptyString(r.TraceID()),
+					traceutil.SpanIDToHexOrEmptyString(r.SpanID()),
+					uint32(r.Flags()),
+					r.SeverityText(),
+					int32(r.SeverityNumber()),
+					serviceName,
+					r.Body().AsString(),
+					resURL,
+					resAttr,
+					scopeURL,
+					scopeName,
+					scopeVersion,
+					scopeAttr,
+					logAttr,
+				}
+				if unixNano {
+					row = append(row, int64(timestamp))
+				}
+				rows = append(rows, row)
+			}
+		}
+	}
+
+	return rows
 }
 
 // DB functions
-func createLogsTable(ctx context.Context, cfg *Config, db *sql.DB) error {
+func createLogsTable(ctx context.Context, cfg *Config, db *sql.DB, logger *zap.Logger) error {
 	log.Println("Creating table....", cfg.LogsTableName)
-	if _, err := db.ExecContext(ctx, renderCreateLogsTableSQL(cfg)); err != nil {
-		return fmt.Errorf("exec create logs table sql: %w", err)
+	target := logsMigrationTarget(cfg)
+	if err := internal.Migrate(ctx, db, logger, cfg.DatabaseConfig.Schema, target, logsMigrations(cfg, logger)); err != nil {
+		return fmt.Errorf("migrate logs table: %w", err)
+	}
+	if cfg.TimestampUnixNano {
+		if _, err := db.ExecContext(ctx, fmt.Sprintf(addTimestampUnixNanoColumnSQL, cfg.logsTable().Sanitize())); err != nil {
+			return fmt.Errorf("add unix nano timestamp column: %w", err)
+		}
 	}
 	return nil
 }
 
+// A relation created along with the logs or traces table, e.g. "MATERIALIZED VIEW" "oteltraces_trace_id_ts_mv"
+type legacyRelation struct {
+	kind string
+	name string
+}
+
+// Before database.schema applied to them, the logs and traces tables were created in the first schema of the
+// search_path, normally public. Refuses to start rather than writing to new, empty tables and leaving the stored
+// data behind, explaining how to move the old relations, the first of which is the table itself.
+func checkLegacyTables(ctx context.Context, client *sql.DB, schemaName string, relations []legacyRelation) error {
+	legacySchema, err := internal.FindLegacyTable(ctx, client, schemaName, relations[0].name)
+	if err != nil {
+		return fmt.Errorf("look up legacy table %s: %w", relations[0].name, err)
+	}
+	if legacySchema == "" {
+		return nil
+	}
+
+	statements := []string{fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s;", internal.QuoteIdentifier(schemaName))}
+	for _, relation := range relations {
+		statements = append(statements, fmt.Sprintf("ALTER %s IF EXISTS %s SET SCHEMA %s;",
+			relation.kind, internal.QuoteIdentifier(legacySchema, relation.name), internal.QuoteIdentifier(schemaName)))
+	}
+
+	return fmt.Errorf("table %s was created by an earlier version of the exporter outside of the configured schema %q, "+
+		"move it there and restart the collector to keep writing to it: %s",
+		internal.QuoteIdentifier(legacySchema, relations[0].name), schemaName, strings.Join(statements, " "))
+}
+
+// Relations created for the logs table, starting with the table
+func logsRelations(cfg *Config) []legacyRelation {
+	return []legacyRelation{{kind: "TABLE", name: cfg.LogsTableName}}
+}
+
+// Every logs table keeps its own version history
+func logsMigrationTarget(cfg *Config) string {
+	return "logs/" + cfg.LogsTableName
+}
+
+// Versioned changes of the logs table. Append new versions, never edit applied ones.
+// The create statement always renders the latest layout, so later versions must be
+// no-ops on freshly created tables.
+func logsMigrations(cfg *Config, logger *zap.Logger) []internal.Migration {
+	return []internal.Migration{
+		{
+			Version:     1,
+			Description: "create logs table",
+			Up:          internal.ExecMigration(renderCreateLogsTableSQL(cfg)),
+		},
+		{
+			Version:     2,
+			Description: "key logs by generated LogId",
+			Up: func(ctx context.Context, tx *sql.Tx) error {
+				return migratePrimaryKey(ctx, tx, cfg.logsTable().Sanitize(), logsPrimaryKey, addLogIdColumnSQL)
+			},
+		},
+		{
+			Version:     3,
+			Description: "store timestamps as TIMESTAMPTZ",
+			Up: func(ctx context.Context, tx *sql.Tx) error {
+				// The generated column can't outlive a type change of the column it's generated from
+				table := cfg.logsTable().Sanitize()
+				return internal.ConvertTimestampColumns(ctx, tx, logger, cfg.DatabaseConfig.Schema, cfg.LogsTableName,
+					[]string{"Timestamp"},
+					[]string{fmt.Sprintf(dropTimestampTimeColumnSQL, table)},
+					[]string{fmt.Sprintf(addTimestampTimeColumnSQL, table)})
+			},
+		},
+	}
+}
+
+// Columns of the BM25 index of the logs table, keyed by "LogId"
+func logsSearchColumns(cfg *Config) ([]string, error) {
+	columns := []string{"Body", "SeverityText", "ServiceName"}
+	for _, column := range cfg.Logs.ParadeDB.IndexedAttributes {
+		if !slices.Contains(logsAttributeColumns, column) {
+			return nil, fmt.Errorf("unknown logs attribute column %q, expected one of %v", column, logsAttributeColumns)
+		}
+		columns = append(columns, column)
+	}
+	return columns, nil
+}
+
 // SQL rendering functions below
 func renderCreateLogsTableSQL(cfg *Config) string {
-	return fmt.Sprintf(createLogsTableSQL, cfg.LogsTableName)
+	return fmt.Sprintf(createLogsTableSQL, cfg.logsTable().Sanitize(),
+		internal.RenderPartitionByClause(cfg.nativePartitioning(cfg.Logs.Partitioning), "Timestamp"))
 }
 
 func renderInsertLogsSQL(cfg *Config) string {
-	return fmt.Sprintf(insertLogsSQLTemplate, cfg.LogsTableName)
+	return internal.RenderInsertSQL(cfg.logsTable().Sanitize(), logsInsertColumns(cfg))
+}
+
+// Columns written on insert, followed by the unix nano timestamp if enabled
+func logsInsertColumns(cfg *Config) []string {
+	if cfg.TimestampUnixNano {
+		return append(slices.Clip(logsColumns), timestampUnixNanoColumnName)
+	}
+	return logsColumns
+}
+
+// "LogId" is generated by the database, so two records never collide.
+// "Timestamp" is part of the key to keep it usable on tables partitioned by time.
+var logsPrimaryKey = []string{"LogId", "Timestamp"}
+
+// JSONB attribute columns of the logs table, the ones paradedb.indexed_attributes can add to the search index
+var logsAttributeColumns = []string{"ResourceAttributes", "ScopeAttributes", "LogAttributes"}
+
+// Columns written on insert, in the order of the values built by logsToRows
+var logsColumns = []string{
+	"Timestamp",
+	"TraceId",
+	"SpanId",
+	"TraceFlags",
+	"SeverityText",
+	"SeverityNumber",
+	"ServiceName",
+	"Body",
+	"ResourceSchemaUrl",
+	"ResourceAttributes",
+	"ScopeSchemaUrl",
+	"ScopeName",
+	"ScopeVersion",
+	"ScopeAttributes",
+	"LogAttributes",
 }
 
 const (
 	createLogsTableSQL = `
 		CREATE TABLE IF NOT EXISTS %s (
-		"Timestamp" TIMESTAMP(9) NOT NULL,
-		"TimestampTime" TIMESTAMP GENERATED ALWAYS AS ("Timestamp") STORED,
+		"LogId" UUID NOT NULL DEFAULT gen_random_uuid(),
+		"Timestamp" TIMESTAMPTZ NOT NULL,
+		"TimestampTime" TIMESTAMPTZ GENERATED ALWAYS AS ("Timestamp") STORED,
 		"TraceId" TEXT,
 		"SpanId" TEXT,
 		"TraceFlags" SMALLINT,
@@ -157,31 +343,22 @@ const (
 		"ScopeAttributes" JSONB,
 		"LogAttributes" JSONB,
 
-		PRIMARY KEY ("ServiceName", "TimestampTime")
-		);
+		PRIMARY KEY ("LogId", "Timestamp")
+		) %s;
 	`
 
-	insertLogsSQLTemplate = `
-	INSERT INTO %s (
-		"Timestamp",
-		"TraceId",
-		"SpanId",
-		"TraceFlags",
-		"SeverityText",
-		"SeverityNumber",
-		"ServiceName",
-		"Body",
-		"ResourceSchemaUrl",
-		"ResourceAttributes",
-		"ScopeSchemaUrl",
-		"ScopeName",
-		"ScopeVersion",
-		"ScopeAttributes",
-		"LogAttributes"
-	) VALUES (
-		$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15
-	);
+	addLogIdColumnSQL = `
+	ALTER TABLE %s ADD COLUMN IF NOT EXISTS "LogId" UUID NOT NULL DEFAULT gen_random_uuid();
 	`
+
+	dropTimestampTimeColumnSQL = `ALTER TABLE %s DROP COLUMN IF EXISTS "TimestampTime"`
+	addTimestampTimeColumnSQL  = `ALTER TABLE %s ADD COLUMN "TimestampTime" TIMESTAMPTZ GENERATED ALWAYS AS ("Timestamp") STORED`
+)
+
+// TIMESTAMPTZ keeps microseconds, this column keeps the nanoseconds of OTLP timestamps if enabled
+const (
+	timestampUnixNanoColumnName   = "TimestampUnixNano"
+	addTimestampUnixNanoColumnSQL = `ALTER TABLE %s ADD COLUMN IF NOT EXISTS "TimestampUnixNano" BIGINT`
 )
 
 func doWithTx(_ context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
@@ -198,14 +375,164 @@ func doWithTx(_ context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
 	return tx.Commit()
 }
 
-func attributesToMap(attributes pcommon.Map) string {
-	m := make(map[string]string, attributes.Len())
-	attributes.Range(func(k string, v pcommon.Value) bool {
-		m[k] = v.AsString()
-		return true
+// Starts the background maintenance of a logs or traces table.
+// The partitions of a partitioned table are created once before returning, so inserts never miss them.
+func startMaintenance(ctx context.Context, client *sql.DB, logger *zap.Logger, cfg *Config, tableName string, partitioning internal.PartitioningConfig, retention time.Duration) (*internal.Maintainer, error) {
+	var tasks []internal.MaintenanceTask
+	schemaName := cfg.DatabaseConfig.Schema
+
+	if partitioning.Enabled() {
+		partitioned, err := internal.IsPartitioned(ctx, client, schemaName, tableName)
+		if err != nil {
+			return nil, fmt.Errorf("check partitioning of %s: %w", tableName, err)
+		}
+
+		if partitioned {
+			task := internal.MaintenanceTask{
+				Name: "partitions of " + tableName,
+				Run: func(ctx context.Context) error {
+					return internal.MaintainPartitions(ctx, client, schemaName, tableName, partitioning, time.Now())
+				},
+			}
+			if err := task.Run(ctx); err != nil {
+				return nil, err
+			}
+			tasks = append(tasks, task)
+		} else {
+			logger.Warn("Partitioning is configured but the table was created without it, it only applies to new tables",
+				zap.String("table", tableName))
+		}
+	}
+
+	if retention > 0 {
+		if cfg.shouldCreateSchema() {
+			if err := internal.EnsureTimestampIndex(ctx, client, cfg.DatabaseConfig.Type, schemaName, tableName, "Timestamp"); err != nil {
+				return nil, err
+			}
+		}
+
+		tasks = append(tasks, internal.MaintenanceTask{
+			Name: "retention of " + tableName,
+			Run: func(ctx context.Context) error {
+				return internal.EnforceRetention(ctx, client, cfg.DatabaseConfig.Type, schemaName, tableName,
+					"Timestamp", partitioning, retention, time.Now())
+			},
+			Immediate: true,
+		})
+	}
+
+	maintainer := internal.NewMaintainer(logger, cfg.MaintenanceInterval, tasks...)
+	maintainer.Start()
+
+	return maintainer, nil
+}
+
+// Replaces the primary key of a table created by an older version of the exporter.
+// The optional addColumnsSQL template is executed first to add missing key columns.
+func migratePrimaryKey(ctx context.Context, tx *sql.Tx, table string, keyColumns []string, addColumnsSQL string) error {
+	name, columns, err := internal.GetPrimaryKey(ctx, tx, table)
+	if err != nil {
+		return err
+	}
+	if slices.Equal(columns, keyColumns) {
+		return nil
+	}
+
+	if addColumnsSQL != "" {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(addColumnsSQL, table)); err != nil {
+			return fmt.Errorf("add key columns: %w", err)
+		}
+	}
+	if err := checkKeyRows(ctx, tx, table, keyColumns); err != nil {
+		return err
+	}
+	if name != "" {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT %s", table, internal.QuoteIdentifier(name))); err != nil {
+			return fmt.Errorf("drop primary key: %w", err)
+		}
+	}
+
+	quoted := make([]string, len(keyColumns))
+	for i, column := range keyColumns {
+		quoted[i] = internal.QuoteIdentifier(column)
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD PRIMARY KEY (%s)", table, strings.Join(quoted, ", "))); err != nil {
+		return fmt.Errorf("add primary key: %w", err)
+	}
+	return nil
+}
+
+// Fails with the statements removing them if rows have a NULL or duplicate key, which the old key allowed
+// and the new one rejects. Rows aren't deleted on startup, it's up to the user which ones to keep.
+func checkKeyRows(ctx context.Context, tx *sql.Tx, table string, keyColumns []string) error {
+	nullKey := renderNullKeyCondition(keyColumns)
+
+	var nulls, duplicates int64
+	if err := tx.QueryRowContext(ctx, fmt.Sprintf("SELECT count(*) FROM %s WHERE %s", table, nullKey)).Scan(&nulls); err != nil {
+		return fmt.Errorf("count NULL keys: %w", err)
+	}
+	if err := tx.QueryRowContext(ctx, renderDuplicateKeysSQL(table, keyColumns)).Scan(&duplicates); err != nil {
+		return fmt.Errorf("count duplicate keys: %w", err)
+	}
+	if nulls == 0 && duplicates == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%s has %d rows with a NULL key and %d keys shared by several rows, which the primary key (%s) "+
+		"rejects. Remove them, e.g. with DELETE FROM %s WHERE %s; %s; and restart",
+		table, nulls, duplicates, strings.Join(keyColumns, ", "), table, nullKey, renderDeleteDuplicateKeysSQL(table, keyColumns))
+}
+
+func renderNullKeyCondition(keyColumns []string) string {
+	conditions := make([]string, len(keyColumns))
+	for i, column := range keyColumns {
+		conditions[i] = internal.QuoteIdentifier(column) + " IS NULL"
+	}
+	return strings.Join(conditions, " OR ")
+}
+
+func renderDuplicateKeysSQL(table string, keyColumns []string) string {
+	quoted := make([]string, len(keyColumns))
+	for i, column := range keyColumns {
+		quoted[i] = internal.QuoteIdentifier(column)
+	}
+	return fmt.Sprintf("SELECT count(*) FROM (SELECT 1 FROM %s GROUP BY %s HAVING count(*) > 1) AS duplicates",
+		table, strings.Join(quoted, ", "))
+}
+
+// Keeps one row of every key. Rows sharing the time in the key share the partition, so ctid tells them apart.
+func renderDeleteDuplicateKeysSQL(table string, keyColumns []string) string {
+	conditions := []string{"a.tableoid = b.tableoid", "a.ctid < b.ctid"}
+	for _, column := range keyColumns {
+		quoted := internal.QuoteIdentifier(column)
+		conditions = append(conditions, fmt.Sprintf("a.%s = b.%s", quoted, quoted))
+	}
+	return fmt.Sprintf("DELETE FROM %s a USING %s b WHERE %s", table, table, strings.Join(conditions, " AND "))
+}
+
+// Executes the insert statement once per row inside a single transaction
+func insertRows(ctx context.Context, client *sql.DB, insertSQL string, rows [][]any) error {
+	return doWithTx(ctx, client, func(tx *sql.Tx) error {
+		statement, err := tx.PrepareContext(ctx, insertSQL)
+		if err != nil {
+			return fmt.Errorf("PrepareContext:%w", err)
+		}
+		defer func() {
+			_ = statement.Close()
+		}()
+
+		for _, row := range rows {
+			if _, err := statement.ExecContext(ctx, row...); err != nil {
+				return fmt.Errorf("ExecContext:%w", err)
+			}
+		}
+		return nil
 	})
+}
 
-	json_string, _ := json.Marshal(m)
+// Encodes attributes as a JSON object preserving value types, see internal.MarshalAttributes
+func attributesToJSON(attributes pcommon.Map) string {
+	json_string, _ := internal.MarshalAttributes(attributes)
 	return string(json_string)
 }
 
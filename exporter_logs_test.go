@@ -0,0 +1,81 @@
+package postgresexporter
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/plog"
+)
+
+func TestAttributesToJSON(t *testing.T) {
+	attrs := pcommon.NewMap()
+	attrs.PutStr("http.method", "GET")
+	attrs.PutInt("http.status_code", 503)
+	attrs.PutDouble("ratio", 0.25)
+	attrs.PutDouble("nan", math.NaN())
+	attrs.PutBool("retry", true)
+	attrs.PutEmptySlice("tags").FromRaw([]any{"a", int64(1)})
+	attrs.PutEmptyMap("peer").PutStr("name", "db")
+
+	var got map[string]any
+	require.NoError(t, json.Unmarshal([]byte(attributesToJSON(attrs)), &got))
+
+	assert.Equal(t, map[string]any{
+		"http.method":      "GET",
+		"http.status_code": float64(503),
+		"ratio":            0.25,
+		"nan":              "NaN",
+		"retry":            true,
+		"tags":             []any{"a", float64(1)},
+		"peer":             map[string]any{"name": "db"},
+	}, got)
+}
+
+func TestLogsSQLUsesSchema(t *testing.T) {
+	cfg := createDefaultConfig().(*Config)
+	cfg.DatabaseConfig.Schema = "tenant-a"
+	cfg.LogsTableName = `my"logs`
+
+	assert.Contains(t, renderCreateLogsTableSQL(cfg), `CREATE TABLE IF NOT EXISTS "tenant-a"."my""logs" (`)
+	assert.Contains(t, renderInsertLogsSQL(cfg), `INSERT INTO "tenant-a"."my""logs" (`)
+}
+
+func TestLogsSearchColumns(t *testing.T) {
+	cfg := createDefaultConfig().(*Config)
+
+	columns, err := logsSearchColumns(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Body", "SeverityText", "ServiceName", "LogAttributes"}, columns)
+
+	cfg.Logs.ParadeDB.IndexedAttributes = []string{"SpanAttributes"}
+	_, err = logsSearchColumns(cfg)
+	assert.ErrorContains(t, err, `unknown logs attribute column "SpanAttributes"`)
+}
+
+func TestLogsToRowsUnixNano(t *testing.T) {
+	ld := plog.NewLogs()
+	record := ld.ResourceLogs().AppendEmpty().ScopeLogs().AppendEmpty().LogRecords().AppendEmpty()
+	timestamp := time.Date(2025, 1, 2, 3, 4, 5, 123456789, time.UTC)
+	record.SetObservedTimestamp(pcommon.NewTimestampFromTime(timestamp))
+
+	rows := logsToRows(ld, false)
+	require.Len(t, rows, 1)
+	assert.Len(t, rows[0], len(logsColumns))
+	assert.Equal(t, timestamp, rows[0][0])
+
+	cfg := createDefaultConfig().(*Config)
+	cfg.TimestampUnixNano = true
+	columns := logsInsertColumns(cfg)
+	assert.Equal(t, "TimestampUnixNano", columns[len(columns)-1])
+	assert.Len(t, logsColumns, len(columns)-1)
+
+	rows = logsToRows(ld, true)
+	require.Len(t, rows, 1)
+	require.Len(t, rows[0], len(columns))
+	assert.Equal(t, timestamp.UnixNano(), rows[0][len(columns)-1])
+}
@@ -5,38 +5,39 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/destrex271/postgresexporter/internal"
 	"go.opentelemetry.io/collector/component"
+	"go.opentelemetry.io/collector/consumer/consumererror"
 	"go.opentelemetry.io/collector/exporter"
 	"go.opentelemetry.io/collector/pdata/pmetric"
 	"go.uber.org/zap"
 )
 
 type metricsExporter struct {
-	client *sql.DB
+	client        *sql.DB
+	maintainer    *internal.Maintainer
+	cache         *internal.MetricsCache
+	sumNormalizer *internal.SumNormalizer
 
 	config *Config
 	logger *zap.Logger
 }
 
 func newMetricsExporter(config *Config, set exporter.Settings) (*metricsExporter, error) {
-	client, err := config.buildDB()
-	if err != nil {
-		return nil, err
-	}
-
 	return &metricsExporter{
-		client: client,
-		config: config,
-		logger: set.Logger,
+		cache:         internal.NewMetricsCache(),
+		sumNormalizer: internal.NewSumNormalizer(config.Metrics.SumTemporality),
+		config:        config,
+		logger:        set.Logger,
 	}, nil
 }
 
 func (e *metricsExporter) ConsumeMetrics(ctx context.Context, md pmetric.Metrics) error {
 	e.logger.Debug("Preparing to save metrics into postgres", zap.Int("Metric count", md.MetricCount()))
 
-	metricsGroupMap := internal.NewMetricsGroupMap(e.config.DatabaseConfig.Type, e.config.DatabaseConfig.Schema)
+	metricsGroupMap := internal.NewMetricsGroupMap(e.settings())
 
 	for i := 0; i < md.ResourceMetrics().Len(); i++ {
 		rMetrics := md.ResourceMetrics().At(i)
@@ -71,14 +72,14 @@ func (e *metricsExporter) ConsumeMetrics(ctx context.Context, md pmetric.Metrics
 				case pmetric.MetricTypeSummary:
 					errs = errors.Join(errs, metricsGroupMap[pmetric.MetricTypeSummary].Add(&resMetadata, m.Summary(), m.Name(), m.Description(), m.Unit(), m.Metadata()))
 				case pmetric.MetricTypeEmpty:
-					return fmt.Errorf("metrics type is unset")
+					return consumererror.NewPermanent(fmt.Errorf("metrics type is unset"))
 				default:
-					return fmt.Errorf("unsupported metrics type")
+					return consumererror.NewPermanent(fmt.Errorf("unsupported metrics type"))
 				}
 
 				if errs != nil {
 					e.logger.Debug(errs.Error())
-					return errs
+					return consumererror.NewPermanent(errs)
 				}
 			}
 		}
@@ -92,24 +93,96 @@ func (e *metricsExporter) Start(ctx context.Context, host component.Host) error
 
 	internal.SetLogger(e.logger)
 
-	if !e.config.shouldCreateSchema() {
-		return nil
+	client, err := pools.acquire(ctx, e.config, host)
+	if err != nil {
+		return err
 	}
+	e.client = client
 
-	if err := internal.CreateSchema(ctx, e.client, e.config.DatabaseConfig.Schema); err != nil {
-		return err
+	if e.config.shouldCreateSchema() {
+		if err := internal.CreateSchema(ctx, e.client, e.config.DatabaseConfig.Schema); err != nil {
+			return err
+		}
+
+		if err := internal.MigrateMetrics(ctx, e.client, e.config.DatabaseConfig.Schema); err != nil {
+			return fmt.Errorf("migrate metrics schema: %w", err)
+		}
+
+		if err := internal.PrepareMetricTables(ctx, e.client, e.settings()); err != nil {
+			return fmt.Errorf("prepare metric tables: %w", err)
+		}
 	}
 
-	if err := internal.CreateAttributesMappingTable(ctx, e.client, e.config.DatabaseConfig.Schema); err != nil {
-		return err
+	var tasks []internal.MaintenanceTask
+	if settings := e.settings(); settings.Partitioning.Enabled() && settings.DBType != internal.DBTypeTimescaleDB {
+		task := internal.MaintenanceTask{
+			Name: "metric partitions",
+			Run: func(ctx context.Context) error {
+				return internal.MaintainMetricPartitions(ctx, e.client, settings, time.Now())
+			},
+		}
+		if err := task.Run(ctx); err != nil {
+			return err
+		}
+		tasks = append(tasks, task)
+	}
+
+	tasks = append(tasks, internal.MaintenanceTask{
+		Name: "metrics retention",
+		Run: func(ctx context.Context) error {
+			return internal.EnforceMetricsRetention(ctx, e.client, e.settings(), time.Now())
+		},
+		Immediate: true,
+	})
+
+	if e.sumNormalizer != nil {
+		tasks = append(tasks, internal.MaintenanceTask{
+			Name: "sum series expiry",
+			Run: func(context.Context) error {
+				e.sumNormalizer.Expire(time.Now())
+				return nil
+			},
+		})
 	}
 
+	e.maintainer = internal.NewMaintainer(e.logger, e.config.MaintenanceInterval, tasks...)
+	e.maintainer.Start()
+
 	return nil
 }
 
+func (e *metricsExporter) settings() internal.MetricsSettings {
+	return internal.MetricsSettings{
+		DBType:     e.config.DatabaseConfig.Type,
+		SchemaName: e.config.DatabaseConfig.Schema,
+		UseCopy:    e.config.Metrics.UseCopy,
+
+		Partitioning:    e.config.Metrics.Partitioning,
+		Retention:       e.config.Metrics.Retention,
+		RetentionByType: e.config.Metrics.RetentionByType,
+
+		Layout:             e.config.Metrics.Layout,
+		AttributesStorage:  e.config.Metrics.AttributesStorage,
+		AttributesGINIndex: e.config.Metrics.AttributesGINIndex,
+
+		AttributeColumns:         e.config.Metrics.AttributeColumns,
+		AttributeColumnsByMetric: e.config.Metrics.AttributeColumnsByMetric,
+
+		ExemplarsTable:     e.config.Metrics.ExemplarsTable,
+		NativeArrays:       e.config.Metrics.NativeArrays,
+		UnixNanoTimestamps: e.config.TimestampUnixNano,
+
+		Cache:         e.cache,
+		SumNormalizer: e.sumNormalizer,
+	}
+}
+
 func (e *metricsExporter) Shutdown(_ context.Context) error {
+	if e.maintainer != nil {
+		e.maintainer.Shutdown()
+	}
 	if e.client != nil {
-		e.client.Close()
+		return pools.release(e.config)
 	}
 	return nil
 }
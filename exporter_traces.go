@@ -3,10 +3,13 @@ package postgresexporter
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
-	"log"
+	"slices"
 	"time"
 
+	"github.com/destrex271/postgresexporter/internal"
+	"github.com/destrex271/postgresexporter/internal/db"
 	"github.com/destrex271/postgresexporter/internal/traceutil"
 	"go.opentelemetry.io/collector/component"
 	"go.opentelemetry.io/collector/pdata/ptrace"
@@ -15,123 +18,211 @@ import (
 )
 
 type tracesExporter struct {
-	client    *sql.DB
-	insertSQL string
-	logger    *zap.Logger
-	cfg       *Config
+	client     *sql.DB
+	insertSQL  string
+	columns    []string
+	logger     *zap.Logger
+	cfg        *Config
+	maintainer *internal.Maintainer
 }
 
 func newTracesExporter(logger *zap.Logger, cfg *Config) (*tracesExporter, error) {
-	client, err := cfg.buildDB()
-	if err != nil {
-		return nil, err
-	}
-
 	return &tracesExporter{
-		client:    client,
 		insertSQL: renderInsertTracesSQL(cfg),
+		columns:   tracesInsertColumns(cfg),
 		logger:    logger,
 		cfg:       cfg,
 	}, nil
 }
 
-func (e *tracesExporter) start(ctx context.Context, _ component.Host) error {
-	return createTracesTable(ctx, e.cfg, e.client)
+func (e *tracesExporter) start(ctx context.Context, host component.Host) error {
+	client, err := pools.acquire(ctx, e.cfg, host)
+	if err != nil {
+		return err
+	}
+	e.client = client
+
+	// Without create_schema the tables are managed elsewhere, but a schema of a newer exporter is still refused
+	err = internal.CheckSchemaVersion(ctx, e.client, e.cfg.DatabaseConfig.Schema, tracesMigrationTarget(e.cfg), tracesMigrations(e.cfg, e.logger))
+	if err != nil {
+		return fmt.Errorf("check traces schema version: %w", err)
+	}
+
+	if err := checkLegacyTables(ctx, e.client, e.cfg.DatabaseConfig.Schema, tracesRelations(e.cfg)); err != nil {
+		return err
+	}
+
+	if e.cfg.shouldCreateSchema() {
+		if err := internal.CreateSchema(ctx, e.client, e.cfg.DatabaseConfig.Schema); err != nil {
+			return err
+		}
+
+		if err := createTracesTable(ctx, e.cfg, e.client, e.logger); err != nil {
+			return err
+		}
+
+		switch e.cfg.DatabaseConfig.Type {
+		case internal.DBTypeTimescaleDB:
+			err := internal.SetupHypertable(ctx, e.client, e.cfg.DatabaseConfig.Schema, e.cfg.TracesTableName,
+				"Timestamp", "ServiceName", e.cfg.Traces.TimescaleDB)
+			if err != nil {
+				return err
+			}
+		case internal.DBTypeParadeDB:
+			if _, err := e.client.ExecContext(ctx, fmt.Sprintf(addSpanUidColumnSQL, e.cfg.tracesTable().Sanitize())); err != nil {
+				return fmt.Errorf("add search key column: %w", err)
+			}
+			err := internal.CreateBM25Index(ctx, e.client, e.cfg.DatabaseConfig.Schema, e.cfg.TracesTableName, "SpanUid", tracesSearchColumns)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	maintainer, err := startMaintenance(ctx, e.client, e.logger, e.cfg, e.cfg.TracesTableName, e.cfg.nativePartitioning(e.cfg.Traces.Partitioning), e.cfg.Traces.Retention)
+	if err != nil {
+		return err
+	}
+	e.maintainer = maintainer
+
+	return nil
 }
 
 func (e *tracesExporter) shutdown(_ context.Context) error {
+	if e.maintainer != nil {
+		e.maintainer.Shutdown()
+	}
 	if e.client != nil {
-		return e.client.Close()
+		return pools.release(e.cfg)
 	}
 	return nil
 }
 
+// Span event as stored in the "Events" JSONB column
+type spanEvent struct {
+	Timestamp              time.Time       `json:"timestamp"`
+	Name                   string          `json:"name"`
+	Attributes             json.RawMessage `json:"attributes"`
+	DroppedAttributesCount uint32          `json:"dropped_attributes_count"`
+}
+
+// Span link as stored in the "Links" JSONB column
+type spanLink struct {
+	TraceID                string          `json:"trace_id"`
+	SpanID                 string          `json:"span_id"`
+	TraceState             string          `json:"trace_state"`
+	Flags                  uint32          `json:"flags"`
+	Attributes             json.RawMessage `json:"attributes"`
+	DroppedAttributesCount uint32          `json:"dropped_attributes_count"`
+}
+
 func convertEvents(events ptrace.SpanEventSlice) string {
-	var eventString []string
+	eventsData := make([]spanEvent, 0, events.Len())
 	for i := 0; i < events.Len(); i++ {
 		event := events.At(i)
-		time := event.Timestamp().String()
-		name := event.Name()
-		attr := attributesToMap(event.Attributes())
-		evt := fmt.Sprintf("{%s, %s, %s}", time, name, attr)
-		eventString = append(eventString, evt)
+		eventsData = append(eventsData, spanEvent{
+			Timestamp:              event.Timestamp().AsTime(),
+			Name:                   event.Name(),
+			Attributes:             json.RawMessage(attributesToJSON(event.Attributes())),
+			DroppedAttributesCount: event.DroppedAttributesCount(),
+		})
 	}
-	return marshalSliceToString(eventString)
+	return marshalSliceToString(eventsData)
 }
 
 func convertLinks(links ptrace.SpanLinkSlice) string {
-	var linksData []string
+	linksData := make([]spanLink, 0, links.Len())
 	for i := 0; i < links.Len(); i++ {
 		link := links.At(i)
-		traceID := traceutil.TraceIDToHexOrEmptyString(link.TraceID())
-		spanIDs := traceutil.SpanIDToHexOrEmptyString(link.SpanID())
-		states := link.TraceState().AsRaw()
-		attrs := attributesToMap(link.Attributes())
-		lnk := fmt.Sprintf("{%s, %s, %s, %s}", traceID, spanIDs, states, attrs)
-		linksData = append(linksData, lnk)
+		linksData = append(linksData, spanLink{
+			TraceID:                traceutil.TraceIDToHexOrEmptyString(link.TraceID()),
+			SpanID:                 traceutil.SpanIDToHexOrEmptyString(link.SpanID()),
+			TraceState:             link.TraceState().AsRaw(),
+			Flags:                  link.Flags(),
+			Attributes:             json.RawMessage(attributesToJSON(link.Attributes())),
+			DroppedAttributesCount: link.DroppedAttributesCount(),
+		})
 	}
 	return marshalSliceToString(linksData)
 }
 
 func (e *tracesExporter) pushTraceData(ctx context.Context, td ptrace.Traces) error {
 	start := time.Now()
-	err := doWithTx(ctx, e.client, func(tx *sql.Tx) error {
-		statement, err := tx.PrepareContext(ctx, e.insertSQL)
-		if err != nil {
-			return fmt.Errorf("PrepareContext:%w", err)
-		}
-		defer func() {
-			_ = statement.Close()
-		}()
-		for i := 0; i < td.ResourceSpans().Len(); i++ {
-			spans := td.ResourceSpans().At(i)
-			res := spans.Resource()
-			resAttr := attributesToMap(res.Attributes())
-			var serviceName string
-			if v, ok := res.Attributes().Get(conventions.AttributeServiceName); ok {
-				serviceName = v.Str()
-			}
-			for j := 0; j < spans.ScopeSpans().Len(); j++ {
-				rs := spans.ScopeSpans().At(j).Spans()
-				scopeName := spans.ScopeSpans().At(j).Scope().Name()
-				scopeVersion := spans.ScopeSpans().At(j).Scope().Version()
-				for k := 0; k < rs.Len(); k++ {
-					r := rs.At(k)
-					spanAttr := attributesToMap(r.Attributes())
-					status := r.Status()
-					events := convertEvents(r.Events())
-					links := convertLinks(r.Links())
-					_, err = statement.ExecContext(ctx,
-						r.StartTimestamp().AsTime(),
-						traceutil.TraceIDToHexOrEmptyString(r.TraceID()),
-						traceutil.SpanIDToHexOrEmptyString(r.SpanID()),
-						traceutil.SpanIDToHexOrEmptyString(r.ParentSpanID()),
-						r.TraceState().AsRaw(),
-						r.Name(),
-						r.Kind().String(),
-						serviceName,
-						resAttr,
-						scopeName,
-						scopeVersion,
-						spanAttr,
-						r.EndTimestamp().AsTime().Sub(r.StartTimestamp().AsTime()).Nanoseconds(),
-						status.Code().String(),
-						status.Message(),
-						events,
-						links,
-					)
-					if err != nil {
-						return fmt.Errorf("ExecContext:%w", err)
-					}
-				}
+	rows := tracesToRows(td, e.cfg.TimestampUnixNano)
+
+	var err error
+	if e.cfg.Traces.UseCopy {
+		table := e.cfg.tracesTable()
+		if onConflict := renderTracesOnConflictClause(e.cfg); onConflict != "" {
+			// Like one INSERT per span, the last of the spans of a batch sharing the key is stored on update
+			var distinctKey []string
+			if e.cfg.Traces.OnConflict == internal.ConflictActionUpdate {
+				distinctKey = tracesPrimaryKey
 			}
+			_, err = db.CopyFromStaging(ctx, e.client, table, e.columns, rows, distinctKey, onConflict)
+		} else {
+			_, err = db.CopyFrom(ctx, e.client, table, e.columns, rows)
 		}
-		return nil
-	})
+	} else {
+		err = insertRows(ctx, e.client, e.insertSQL, rows)
+	}
+
 	duration := time.Since(start)
 	e.logger.Debug("insert traces", zap.Int("records", td.SpanCount()),
 		zap.String("cost", duration.String()))
-	return err
+	return internal.ClassifyError(err)
+}
+
+// Flattens spans into rows ordered as tracesColumns, followed by the unix nano start timestamp if enabled
+func tracesToRows(td ptrace.Traces, unixNano bool) [][]any {
+	rows := make([][]any, 0, td.SpanCount())
+
+	for i := 0; i < td.ResourceSpans().Len(); i++ {
+		spans := td.ResourceSpans().At(i)
+		res := spans.Resource()
+		resAttr := attributesToJSON(res.Attributes())
+		var serviceName string
+		if v, ok := res.Attributes().Get(conventions.AttributeServiceName); ok {
+			serviceName = v.Str()
+		}
+		for j := 0; j < spans.ScopeSpans().Len(); j++ {
+			rs := spans.ScopeSpans().At(j).Spans()
+			scopeName := spans.ScopeSpans().At(j).Scope().Name()
+			scopeVersion := spans.ScopeSpans().At(j).Scope().Version()
+			for k := 0; k < rs.Len(); k++ {
+				r := rs.At(k)
+				spanAttr := attributesToJSON(r.Attributes())
+				status := r.Status()
+				events := convertEvents(r.Events())
+				links := convertLinks(r.Links())
+				row := []any{
+					r.StartTimestamp().AsTime(),
+					traceutil.TraceIDToHexOrEmptyString(r.TraceID()),
+					traceutil.SpanIDToHexOrEmptyString(r.SpanID()),
+					traceutil.SpanIDToHexOrEmptyString(r.ParentSpanID()),
+					r.TraceState().AsRaw(),
+					r.Name(),
+					r.Kind().String(),
+					serviceName,
+					resAttr,
+					scopeName,
+					scopeVersion,
+					spanAttr,
+					r.EndTimestamp().AsTime().Sub(r.StartTimestamp().AsTime()).Nanoseconds(),
+					status.Code().String(),
+					status.Message(),
+					events,
+					links,
+				}
+				if unixNano {
+					row = append(row, int64(r.StartTimestamp()))
+				}
+				rows = append(rows, row)
+			}
+		}
+	}
+
+	return rows
 }
 
 // SQL Content from below
@@ -139,7 +230,7 @@ const (
 	// language=PostgreSQL
 	createTracesTableSQL = `
 	CREATE TABLE IF NOT EXISTS %s (
-		"Timestamp" TIMESTAMP(9) NOT NULL,
+		"Timestamp" TIMESTAMPTZ NOT NULL,
 		"TraceId" TEXT,
 		"SpanId" TEXT,
 		"ParentSpanId" TEXT,
@@ -157,64 +248,54 @@ const (
 		"Events" JSONB, -- Using JSONB to store the Nested events structure
 		"Links" JSONB,  -- Using JSONB to store the Nested links structure
 
-		PRIMARY KEY ("ServiceName", "SpanName", "Timestamp")
-	);
+		PRIMARY KEY ("TraceId", "SpanId", "Timestamp")
+	) %s;
 `
-	// language=PostgreSQL
-	insertTracesSQLTemplate = `
-	INSERT INTO %s (
-		"Timestamp",
-		"TraceId",
-		"SpanId",
-		"ParentSpanId",
-		"TraceState",
-		"SpanName",
-		"SpanKind",
-		"ServiceName",
-		"ResourceAttributes",
-		"ScopeName",
-		"ScopeVersion",
-		"SpanAttributes",
-		"Duration",
-		"StatusCode",
-		"StatusMessage",
-		"Events",
-		"Links"
-	) VALUES (
-		$1, -- "Timestamp"
-		$2, -- "TraceId"
-		$3, -- "SpanId"
-		$4, -- "ParentSpanId"
-		$5, -- "TraceState"
-		$6, -- "SpanName"
-		$7, -- "SpanKind"
-		$8, -- "ServiceName"
-		$9, -- "ResourceAttributes" (JSONB)
-		$10, -- "ScopeName"
-		$11, -- "ScopeVersion"
-		$12, -- "SpanAttributes" (JSONB)
-		$13, -- "Duration"
-		$14, -- "StatusCode"
-		$15, -- "StatusMessage"
-		$16, -- "Events" (JSONB)
-		$17  -- "Links" (JSONB)
-	);
-
-	`
 )
 
+// A span is identified by its trace and span IDs. The start "Timestamp" never differs
+// for the same span and keeps the key usable on tables partitioned by time.
+var tracesPrimaryKey = []string{"TraceId", "SpanId", "Timestamp"}
+
+// Columns written on insert, in the order of the values built by tracesToRows
+var tracesColumns = []string{
+	"Timestamp",
+	"TraceId",
+	"SpanId",
+	"ParentSpanId",
+	"TraceState",
+	"SpanName",
+	"SpanKind",
+	"ServiceName",
+	"ResourceAttributes",
+	"ScopeName",
+	"ScopeVersion",
+	"SpanAttributes",
+	"Duration",
+	"StatusCode",
+	"StatusMessage",
+	"Events",
+	"Links",
+}
+
+// The BM25 index needs a single unique key column, which the composite primary key isn't.
+// It's only added on ParadeDB and filled by the database.
+const addSpanUidColumnSQL = `ALTER TABLE %s ADD COLUMN IF NOT EXISTS "SpanUid" UUID NOT NULL DEFAULT gen_random_uuid()`
+
+var tracesSearchColumns = []string{"SpanName", "StatusMessage"}
+
 const (
 	createTraceIDTsTableSQL = `
-	CREATE TABLE IF NOT EXISTS %s_trace_id_ts (
+	CREATE TABLE IF NOT EXISTS %s (
 		"TraceId" TEXT,
-		"Start" TIMESTAMP,
-		"End" TIMESTAMP,
+		"Start" TIMESTAMPTZ,
+		"End" TIMESTAMPTZ,
 
 		PRIMARY KEY ("TraceId", "Start")
 	);
 `
 	createTraceIDTsMaterializedViewSQL = `
-	CREATE MATERIALIZED VIEW IF NOT EXISTS %s_trace_id_ts_mv AS
+	CREATE MATERIALIZED VIEW IF NOT EXISTS %s AS
 	SELECT
 		"TraceId",
 		MIN("Timestamp") AS "Start",
@@ -223,35 +304,101 @@ const (
 	WHERE "TraceId" != ''
 	GROUP BY "TraceId";
 	`
+	dropMaterializedViewSQL = `DROP MATERIALIZED VIEW IF EXISTS %s`
 )
 
-func createTracesTable(ctx context.Context, cfg *Config, db *sql.DB) error {
-	if _, err := db.ExecContext(ctx, renderCreateTracesTableSQL(cfg)); err != nil {
-		return fmt.Errorf("exec create traces table sql: %w", err)
-	}
-	if _, err := db.ExecContext(ctx, renderCreateTraceIDTsTableSQL(cfg)); err != nil {
-		return fmt.Errorf("exec create traceID timestamp table sql: %w", err)
+func createTracesTable(ctx context.Context, cfg *Config, db *sql.DB, logger *zap.Logger) error {
+	target := tracesMigrationTarget(cfg)
+	if err := internal.Migrate(ctx, db, logger, cfg.DatabaseConfig.Schema, target, tracesMigrations(cfg, logger)); err != nil {
+		return fmt.Errorf("migrate traces table: %w", err)
 	}
-	mv_str := renderTraceIDTsMaterializedViewSQL(cfg)
-	log.Println(mv_str)
-	if _, err := db.ExecContext(ctx, renderTraceIDTsMaterializedViewSQL(cfg)); err != nil {
-		return fmt.Errorf("exec create traceID timestamp view sql: %w", err)
+	if cfg.TimestampUnixNano {
+		if _, err := db.ExecContext(ctx, fmt.Sprintf(addTimestampUnixNanoColumnSQL, cfg.tracesTable().Sanitize())); err != nil {
+			return fmt.Errorf("add unix nano timestamp column: %w", err)
+		}
 	}
 	return nil
 }
 
+// Relations created for the traces table, starting with the table
+func tracesRelations(cfg *Config) []legacyRelation {
+	return []legacyRelation{
+		{kind: "TABLE", name: cfg.TracesTableName},
+		{kind: "TABLE", name: cfg.TracesTableName + "_trace_id_ts"},
+		{kind: "MATERIALIZED VIEW", name: cfg.TracesTableName + "_trace_id_ts_mv"},
+	}
+}
+
+// Every traces table keeps its own version history
+func tracesMigrationTarget(cfg *Config) string {
+	return "traces/" + cfg.TracesTableName
+}
+
+// Versioned changes of the traces tables. Append new versions, never edit applied ones.
+// The create statements always render the latest layout, so later versions must be
+// no-ops on freshly created tables.
+func tracesMigrations(cfg *Config, logger *zap.Logger) []internal.Migration {
+	return []internal.Migration{
+		{
+			Version:     1,
+			Description: "create traces tables",
+			Up: internal.ExecMigration(
+				renderCreateTracesTableSQL(cfg),
+				renderCreateTraceIDTsTableSQL(cfg),
+				renderTraceIDTsMaterializedViewSQL(cfg),
+			),
+		},
+		{
+			Version:     2,
+			Description: "key spans by trace and span ID",
+			Up: func(ctx context.Context, tx *sql.Tx) error {
+				return migratePrimaryKey(ctx, tx, cfg.tracesTable().Sanitize(), tracesPrimaryKey, "")
+			},
+		},
+		{
+			Version:     3,
+			Description: "store timestamps as TIMESTAMPTZ",
+			Up: func(ctx context.Context, tx *sql.Tx) error {
+				// The materialized view has to be recreated to change the type of a column it reads
+				err := internal.ConvertTimestampColumns(ctx, tx, logger, cfg.DatabaseConfig.Schema, cfg.TracesTableName,
+					[]string{"Timestamp"},
+					[]string{fmt.Sprintf(dropMaterializedViewSQL, cfg.tracesTableWithSuffix("_trace_id_ts_mv").Sanitize())},
+					[]string{renderTraceIDTsMaterializedViewSQL(cfg)})
+				if err != nil {
+					return err
+				}
+				return internal.ConvertTimestampColumns(ctx, tx, logger, cfg.DatabaseConfig.Schema, cfg.TracesTableName+"_trace_id_ts",
+					[]string{"Start", "End"}, nil, nil)
+			},
+		},
+	}
+}
+
 func renderInsertTracesSQL(cfg *Config) string {
-	return fmt.Sprintf(insertTracesSQLTemplate, cfg.TracesTableName)
+	return internal.RenderInsertSQL(cfg.tracesTable().Sanitize(), tracesInsertColumns(cfg)) + " " + renderTracesOnConflictClause(cfg)
+}
+
+func renderTracesOnConflictClause(cfg *Config) string {
+	return internal.RenderOnConflictClause(cfg.Traces.OnConflict, tracesPrimaryKey, tracesInsertColumns(cfg))
+}
+
+// Columns written on insert, followed by the unix nano start timestamp if enabled
+func tracesInsertColumns(cfg *Config) []string {
+	if cfg.TimestampUnixNano {
+		return append(slices.Clip(tracesColumns), timestampUnixNanoColumnName)
+	}
+	return tracesColumns
 }
 
 func renderCreateTracesTableSQL(cfg *Config) string {
-	return fmt.Sprintf(createTracesTableSQL, cfg.TracesTableName)
+	return fmt.Sprintf(createTracesTableSQL, cfg.tracesTable().Sanitize(),
+		internal.RenderPartitionByClause(cfg.nativePartitioning(cfg.Traces.Partitioning), "Timestamp"))
 }
 
 func renderCreateTraceIDTsTableSQL(cfg *Config) string {
-	return fmt.Sprintf(createTraceIDTsTableSQL, cfg.TracesTableName)
+	return fmt.Sprintf(createTraceIDTsTableSQL, cfg.tracesTableWithSuffix("_trace_id_ts").Sanitize())
 }
 
 func renderTraceIDTsMaterializedViewSQL(cfg *Config) string {
-	return fmt.Sprintf(createTraceIDTsMaterializedViewSQL, cfg.TracesTableName, cfg.TracesTableName)
+	return fmt.Sprintf(createTraceIDTsMaterializedViewSQL, cfg.tracesTableWithSuffix("_trace_id_ts_mv").Sanitize(), cfg.tracesTable().Sanitize())
 }
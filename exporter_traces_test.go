@@ -0,0 +1,108 @@
+package postgresexporter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/destrex271/postgresexporter/internal"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+func TestConvertEvents(t *testing.T) {
+	events := ptrace.NewSpanEventSlice()
+	assert.JSONEq(t, `[]`, convertEvents(events))
+
+	event := events.AppendEmpty()
+	event.SetTimestamp(pcommon.NewTimestampFromTime(time.Date(2025, 1, 2, 3, 4, 5, 6, time.UTC)))
+	event.SetName("exception")
+	event.Attributes().PutStr("exception.type", "io.EOF")
+	event.Attributes().PutBool("exception.escaped", true)
+	event.SetDroppedAttributesCount(2)
+
+	assert.JSONEq(t, `[{
+		"timestamp": "2025-01-02T03:04:05.000000006Z",
+		"name": "exception",
+		"attributes": {"exception.type": "io.EOF", "exception.escaped": true},
+		"dropped_attributes_count": 2
+	}]`, convertEvents(events))
+}
+
+func TestConvertLinks(t *testing.T) {
+	links := ptrace.NewSpanLinkSlice()
+	assert.JSONEq(t, `[]`, convertLinks(links))
+
+	link := links.AppendEmpty()
+	link.SetTraceID(pcommon.TraceID([16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}))
+	link.SetSpanID(pcommon.SpanID([8]byte{1, 2, 3, 4, 5, 6, 7, 8}))
+	link.TraceState().FromRaw("vendor=value")
+	link.SetFlags(1)
+	link.Attributes().PutInt("retry", 3)
+
+	assert.JSONEq(t, `[{
+		"trace_id": "0102030405060708090a0b0c0d0e0f10",
+		"span_id": "0102030405060708",
+		"trace_state": "vendor=value",
+		"flags": 1,
+		"attributes": {"retry": 3},
+		"dropped_attributes_count": 0
+	}]`, convertLinks(links))
+}
+
+func TestRenderInsertTracesSQLOnConflict(t *testing.T) {
+	cfg := createDefaultConfig().(*Config)
+
+	cfg.Traces.OnConflict = internal.ConflictActionError
+	assert.NotContains(t, renderInsertTracesSQL(cfg), "ON CONFLICT")
+
+	cfg.Traces.OnConflict = internal.ConflictActionDoNothing
+	assert.Contains(t, renderInsertTracesSQL(cfg), `ON CONFLICT ("TraceId", "SpanId", "Timestamp") DO NOTHING`)
+
+	cfg.Traces.OnConflict = internal.ConflictActionUpdate
+	insertSQL := renderInsertTracesSQL(cfg)
+	assert.Contains(t, insertSQL, `ON CONFLICT ("TraceId", "SpanId", "Timestamp") DO UPDATE SET "ParentSpanId" = EXCLUDED."ParentSpanId"`)
+	assert.NotContains(t, insertSQL, `"SpanId" = EXCLUDED."SpanId"`)
+}
+
+func TestRenderKeyCleanupSQL(t *testing.T) {
+	table := createDefaultConfig().(*Config).tracesTable().Sanitize()
+
+	assert.Equal(t, `"TraceId" IS NULL OR "SpanId" IS NULL OR "Timestamp" IS NULL`, renderNullKeyCondition(tracesPrimaryKey))
+	assert.Equal(t,
+		`SELECT count(*) FROM (SELECT 1 FROM "otel"."oteltraces" GROUP BY "TraceId", "SpanId", "Timestamp" HAVING count(*) > 1) AS duplicates`,
+		renderDuplicateKeysSQL(table, tracesPrimaryKey))
+	assert.Equal(t,
+		`DELETE FROM "otel"."oteltraces" a USING "otel"."oteltraces" b WHERE a.tableoid = b.tableoid AND a.ctid < b.ctid `+
+			`AND a."TraceId" = b."TraceId" AND a."SpanId" = b."SpanId" AND a."Timestamp" = b."Timestamp"`,
+		renderDeleteDuplicateKeysSQL(table, tracesPrimaryKey))
+}
+
+func TestTracesSQLUsesSchema(t *testing.T) {
+	cfg := createDefaultConfig().(*Config)
+	cfg.DatabaseConfig.Schema = "tenant-a"
+
+	assert.Contains(t, renderCreateTracesTableSQL(cfg), `CREATE TABLE IF NOT EXISTS "tenant-a"."oteltraces" (`)
+	assert.Contains(t, renderInsertTracesSQL(cfg), `INSERT INTO "tenant-a"."oteltraces" (`)
+	assert.Contains(t, renderCreateTraceIDTsTableSQL(cfg), `CREATE TABLE IF NOT EXISTS "tenant-a"."oteltraces_trace_id_ts" (`)
+	mv := renderTraceIDTsMaterializedViewSQL(cfg)
+	assert.Contains(t, mv, `CREATE MATERIALIZED VIEW IF NOT EXISTS "tenant-a"."oteltraces_trace_id_ts_mv" AS`)
+	assert.Contains(t, mv, `FROM "tenant-a"."oteltraces"`)
+}
+
+func TestTracesUnixNano(t *testing.T) {
+	td := ptrace.NewTraces()
+	span := td.ResourceSpans().AppendEmpty().ScopeSpans().AppendEmpty().Spans().AppendEmpty()
+	start := time.Date(2025, 1, 2, 3, 4, 5, 123456789, time.UTC)
+	span.SetStartTimestamp(pcommon.NewTimestampFromTime(start))
+	span.SetEndTimestamp(pcommon.NewTimestampFromTime(start.Add(time.Second)))
+
+	rows := tracesToRows(td, true)
+	assert.Len(t, rows[0], len(tracesColumns)+1)
+	assert.Equal(t, start.UnixNano(), rows[0][len(tracesColumns)])
+
+	cfg := createDefaultConfig().(*Config)
+	cfg.TimestampUnixNano = true
+	cfg.Traces.OnConflict = internal.ConflictActionUpdate
+	assert.Contains(t, renderInsertTracesSQL(cfg), `"TimestampUnixNano" = EXCLUDED."TimestampUnixNano"`)
+}
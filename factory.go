@@ -4,10 +4,12 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/destrex271/postgresexporter/internal"
 	"github.com/destrex271/postgresexporter/internal/metadata"
 	"go.opentelemetry.io/collector/component"
+	"go.opentelemetry.io/collector/config/configretry"
 	"go.opentelemetry.io/collector/exporter"
 	"go.opentelemetry.io/collector/exporter/exporterhelper"
 )
@@ -32,12 +34,49 @@ func createDefaultConfig() component.Config {
 			Database: "otel",
 			Schema:   "otel",
 			SSLmode:  "disable",
+			Pool: PoolConfig{
+				MaxIdleConns: 2,
+			},
 		},
 		LogsTableName:   "otellogs",
 		TracesTableName: "oteltraces",
-		CreateSchema:    true,
-		TimeoutSettings: exporterhelper.NewDefaultTimeoutConfig(),
-		QueueSettings:   exporterhelper.NewDefaultQueueConfig(),
+		Logs: LogsConfig{
+			Partitioning: defaultPartitioningConfig(),
+			TimescaleDB:  defaultTimescaleDBConfig(),
+			ParadeDB: internal.ParadeDBConfig{
+				IndexedAttributes: []string{"LogAttributes"},
+			},
+		},
+		Traces: TracesConfig{
+			OnConflict:   internal.ConflictActionDoNothing,
+			Partitioning: defaultPartitioningConfig(),
+			TimescaleDB:  defaultTimescaleDBConfig(),
+		},
+		Metrics: MetricsConfig{
+			Partitioning:      defaultPartitioningConfig(),
+			Layout:            internal.MetricsLayoutTablePerMetric,
+			AttributesStorage: internal.AttributesStorageColumns,
+			AttributeColumns:  20,
+			SumTemporality:    internal.SumTemporalityAsReceived,
+		},
+		CreateSchema:        true,
+		MaintenanceInterval: 10 * time.Minute,
+		TimeoutSettings:     exporterhelper.NewDefaultTimeoutConfig(),
+		QueueSettings:       exporterhelper.NewDefaultQueueConfig(),
+		BackOffConfig:       configretry.NewDefaultBackOffConfig(),
+	}
+}
+
+func defaultPartitioningConfig() internal.PartitioningConfig {
+	return internal.PartitioningConfig{
+		Premake: 3,
+	}
+}
+
+func defaultTimescaleDBConfig() internal.TimescaleDBConfig {
+	return internal.TimescaleDBConfig{
+		ChunkInterval: 24 * time.Hour,
+		CompressAfter: 7 * 24 * time.Hour,
 	}
 }
 
@@ -60,6 +99,7 @@ func createMetricsExporter(ctx context.Context, set exporter.Settings, cfg compo
 		exporterhelper.WithShutdown(exporter.Shutdown),
 		exporterhelper.WithQueue(config.QueueSettings),
 		exporterhelper.WithTimeout(config.TimeoutSettings),
+		exporterhelper.WithRetry(config.BackOffConfig),
 	)
 }
 
@@ -82,6 +122,7 @@ func createLogsExporter(
 		s.pushLogsData,
 		exporterhelper.WithStart(s.start),
 		exporterhelper.WithShutdown(s.shutdown),
+		exporterhelper.WithRetry(cfg.BackOffConfig),
 	)
 }
 
@@ -104,5 +145,6 @@ func createTracesExporter(
 		s.pushTraceData,
 		exporterhelper.WithStart(s.start),
 		exporterhelper.WithShutdown(s.shutdown),
+		exporterhelper.WithRetry(cfg.BackOffConfig),
 	)
 }
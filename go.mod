@@ -7,8 +7,10 @@ require (
 	github.com/stretchr/testify v1.10.0
 	go.opentelemetry.io/collector/component v1.28.0
 	go.opentelemetry.io/collector/component/componenttest v0.122.0
+	go.opentelemetry.io/collector/config/configretry v1.28.0
 	go.opentelemetry.io/collector/confmap v1.28.0
 	go.opentelemetry.io/collector/confmap/xconfmap v0.122.0
+	go.opentelemetry.io/collector/consumer/consumererror v0.122.0
 	go.opentelemetry.io/collector/exporter v0.122.0
 	go.opentelemetry.io/collector/exporter/exportertest v0.122.0
 	go.opentelemetry.io/collector/pdata v1.28.0
@@ -39,9 +41,7 @@ require (
 	github.com/modern-go/reflect2 v1.0.2 // indirect
 	github.com/pmezard/go-difflib v1.0.1-0.20181226105442-5d4384ee4fb2 // indirect
 	go.opentelemetry.io/auto/sdk v1.1.0 // indirect
-	go.opentelemetry.io/collector/config/configretry v1.28.0 // indirect
 	go.opentelemetry.io/collector/consumer v1.28.0 // indirect
-	go.opentelemetry.io/collector/consumer/consumererror v0.122.0 // indirect
 	go.opentelemetry.io/collector/consumer/consumertest v0.122.0 // indirect
 	go.opentelemetry.io/collector/consumer/xconsumer v0.122.0 // indirect
 	go.opentelemetry.io/collector/exporter/xexporter v0.122.0 // indirect
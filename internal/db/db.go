@@ -4,25 +4,92 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"net"
 	"net/url"
+	"os"
+	"strconv"
+	"strings"
 
-	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
 )
 
+const stagingTableName = "postgresexporter_staging"
+
+// URL returns the connection URL of a database, escaping every part of it
 func URL(host string, port int, user, password, dbname, sslmode string) string {
-	return fmt.Sprintf(
-		"postgresql://%s:%s@%s:%d/%s?sslmode=%s",
-		user, url.QueryEscape(password), host, port, dbname, sslmode,
-	)
+	u := url.URL{
+		Scheme:   "postgresql",
+		User:     url.UserPassword(user, password),
+		Host:     net.JoinHostPort(host, strconv.Itoa(port)),
+		Path:     "/" + dbname,
+		RawQuery: url.Values{"sslmode": {sslmode}}.Encode(),
+	}
+
+	return u.String()
+}
+
+// ParseConfig parses a pgx connection string, a URL or keyword/value pairs, with the TLS settings
+func ParseConfig(connString string, tlsConfig TLSConfig) (*pgx.ConnConfig, error) {
+	connString, err := tlsConfig.connString(connString)
+	if err != nil {
+		return nil, fmt.Errorf("invalid connection string: %w", err)
+	}
+
+	config, err := pgx.ParseConfig(connString)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tlsConfig.apply(&config.Config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// PasswordFunc returns the password of a new connection
+type PasswordFunc func(ctx context.Context) (string, error)
+
+// FilePassword reads the password from the file for every new connection, so a rotated password
+// is picked up without restarting. A trailing line break is ignored.
+func FilePassword(path string) PasswordFunc {
+	return func(_ context.Context) (string, error) {
+		password, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(password), "\r\n"), nil
+	}
 }
 
-func Open(databaseUrl string) (*sql.DB, error) {
-	db, err := sql.Open("pgx", databaseUrl)
+// Open opens a connection pool. If password isn't nil it's called for every new connection,
+// replacing the password of the connection string.
+func Open(connString string, tlsConfig TLSConfig, password PasswordFunc) (*sql.DB, error) {
+	config, err := ParseConfig(connString, tlsConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed opening connection to postgres: %w", err)
 	}
 
-	return db, nil
+	var options []stdlib.OptionOpenDB
+	if password != nil {
+		options = append(options, stdlib.OptionBeforeConnect(beforeConnect(password)))
+	}
+
+	return stdlib.OpenDB(*config, options...), nil
+}
+
+// Sets the password of the config of a connection about to be opened
+func beforeConnect(password PasswordFunc) func(ctx context.Context, config *pgx.ConnConfig) error {
+	return func(ctx context.Context, config *pgx.ConnConfig) error {
+		p, err := password(ctx)
+		if err != nil {
+			return fmt.Errorf("failed getting postgres password: %w", err)
+		}
+
+		config.Password = p
+		return nil
+	}
 }
 
 func DoWithTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
@@ -41,3 +108,133 @@ func DoWithTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error
 
 	return tx.Commit()
 }
+
+// CopyFrom bulk loads rows into the table with COPY FROM STDIN, using the pgx
+// connection behind one of the pooled database/sql connections.
+// COPY is a single statement, so either all rows are written or none are.
+func CopyFrom(ctx context.Context, db *sql.DB, table pgx.Identifier, columns []string, rows [][]any) (int64, error) {
+	var copied int64
+	err := withPgxConn(ctx, db, func(conn *pgx.Conn) error {
+		var err error
+		copied, err = conn.CopyFrom(ctx, table, columns, pgx.CopyFromRows(rows))
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("CopyFrom: %w", err)
+	}
+
+	return copied, nil
+}
+
+// CopyRows are rows to bulk load into a table with CopyFromAll
+type CopyRows struct {
+	Table   pgx.Identifier
+	Columns []string
+	Rows    [][]any
+}
+
+// CopyFromAll bulk loads rows into several tables with one COPY per table in a transaction,
+// so either all rows are written or none are.
+func CopyFromAll(ctx context.Context, db *sql.DB, copies ...CopyRows) (int64, error) {
+	var copied int64
+	err := withPgxConn(ctx, db, func(conn *pgx.Conn) error {
+		return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			for _, c := range copies {
+				n, err := tx.CopyFrom(ctx, c.Table, c.Columns, pgx.CopyFromRows(c.Rows))
+				if err != nil {
+					return err
+				}
+				copied += n
+			}
+
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, fmt.Errorf("CopyFromAll: %w", err)
+	}
+
+	return copied, nil
+}
+
+// CopyFromStaging bulk loads rows with COPY into a temporary table shaped like the target table
+// and then moves them with INSERT ... SELECT followed by the given suffix, e.g. an ON CONFLICT
+// clause that COPY itself can't express. Both steps run in one transaction.
+// With a distinct key only the last of the rows sharing the key is moved, as ON CONFLICT DO UPDATE
+// fails on a key appearing twice in one statement.
+func CopyFromStaging(ctx context.Context, db *sql.DB, table pgx.Identifier, columns []string, rows [][]any, distinctKey []string, insertSuffix string) (int64, error) {
+	staging := pgx.Identifier{stagingTableName}
+
+	var inserted int64
+	err := withPgxConn(ctx, db, func(conn *pgx.Conn) error {
+		return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, fmt.Sprintf(
+				"CREATE TEMPORARY TABLE %s (LIKE %s INCLUDING DEFAULTS) ON COMMIT DROP",
+				staging.Sanitize(), table.Sanitize(),
+			))
+			if err != nil {
+				return err
+			}
+
+			if _, err := tx.CopyFrom(ctx, staging, columns, pgx.CopyFromRows(rows)); err != nil {
+				return err
+			}
+
+			tag, err := tx.Exec(ctx, renderStagingInsertSQL(table, staging, columns, distinctKey, insertSuffix))
+			if err != nil {
+				return err
+			}
+
+			inserted = tag.RowsAffected()
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, fmt.Errorf("CopyFromStaging: %w", err)
+	}
+
+	return inserted, nil
+}
+
+// Rows are appended to the fresh staging table in the order they're copied, so the highest ctid is the last row
+func renderStagingInsertSQL(table, staging pgx.Identifier, columns, distinctKey []string, insertSuffix string) string {
+	columnList := quoteColumns(columns)
+
+	selectSQL := fmt.Sprintf("SELECT %s FROM %s", columnList, staging.Sanitize())
+	if len(distinctKey) > 0 {
+		keyList := quoteColumns(distinctKey)
+		selectSQL = fmt.Sprintf("SELECT DISTINCT ON (%s) %s FROM %s ORDER BY %s, ctid DESC",
+			keyList, columnList, staging.Sanitize(), keyList)
+	}
+
+	return fmt.Sprintf("INSERT INTO %s (%s) %s %s", table.Sanitize(), columnList, selectSQL, insertSuffix)
+}
+
+func quoteColumns(columns []string) string {
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = pgx.Identifier{column}.Sanitize()
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// Runs fn with the pgx connection behind a database/sql connection taken from the pool
+func withPgxConn(ctx context.Context, db *sql.DB, fn func(conn *pgx.Conn) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("db.Conn: %w", err)
+	}
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	return conn.Raw(func(driverConn any) error {
+		stdlibConn, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return fmt.Errorf("unexpected driver connection type %T", driverConn)
+		}
+
+		return fn(stdlibConn.Conn())
+	})
+}
@@ -0,0 +1,124 @@
+package db
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// TLSConfig holds the TLS settings of the connections besides the sslmode. Like with libpq,
+// a CA file turns sslmode 'require' into 'verify-ca', and 'verify-full' also checks the server name.
+type TLSConfig struct {
+	// PEM encoded CA certificates verifying the server certificate
+	CAFile string `mapstructure:"ca_file"`
+	// PEM encoded client certificate and key, for servers requiring client certificates
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+	// Name expected in the server certificate with sslmode 'verify-full', and sent as SNI, instead of the host
+	ServerNameOverride string `mapstructure:"server_name_override"`
+	// Minimum TLS version, '1.0', '1.1', '1.2' or '1.3'. Default - 1.2
+	MinVersion string `mapstructure:"min_version"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Adds the certificate files to the connection string, so pgx loads them according to the sslmode
+func (c TLSConfig) connString(connString string) (string, error) {
+	params := map[string]string{"sslrootcert": c.CAFile, "sslcert": c.CertFile, "sslkey": c.KeyFile}
+
+	if c.CAFile == "" && c.CertFile == "" && c.KeyFile == "" {
+		return connString, nil
+	}
+
+	if strings.HasPrefix(connString, "postgres://") || strings.HasPrefix(connString, "postgresql://") {
+		// Only the query is rewritten, the rest of the URL is kept as written
+		base, rawQuery, _ := strings.Cut(connString, "?")
+		query, err := url.ParseQuery(rawQuery)
+		if err != nil {
+			return "", err
+		}
+
+		for key, value := range params {
+			if value != "" {
+				query.Set(key, value)
+			}
+		}
+
+		return base + "?" + query.Encode(), nil
+	}
+
+	// Keyword/value connection strings take single quoted values with backslash escapes
+	var b strings.Builder
+	b.WriteString(connString)
+	for _, key := range []string{"sslrootcert", "sslcert", "sslkey"} {
+		if value := params[key]; value != "" {
+			value = strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value)
+			fmt.Fprintf(&b, " %s='%s'", key, value)
+		}
+	}
+
+	return b.String(), nil
+}
+
+// Validate checks the settings pgx would only reject when connecting
+func (c TLSConfig) Validate() error {
+	var errs error
+	if _, err := c.minVersion(); err != nil {
+		errs = errors.Join(errs, err)
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		errs = errors.Join(errs, errors.New("TLS cert_file and key_file must be set together"))
+	}
+
+	return errs
+}
+
+// Returns the minimum TLS version, 0 if it isn't set
+func (c TLSConfig) minVersion() (uint16, error) {
+	if c.MinVersion == "" {
+		return 0, nil
+	}
+
+	version, present := tlsVersions[c.MinVersion]
+	if !present {
+		return 0, fmt.Errorf("unknown TLS min_version %q, expected one of 1.0, 1.1, 1.2 or 1.3", c.MinVersion)
+	}
+	return version, nil
+}
+
+// Applies the settings pgx has no connection parameters for to every TLS config of the connection,
+// there's one per host and fallback
+func (c TLSConfig) apply(config *pgconn.Config) error {
+	minVersion, err := c.minVersion()
+	if err != nil {
+		return err
+	}
+
+	configs := []*tls.Config{config.TLSConfig}
+	for _, fallback := range config.Fallbacks {
+		configs = append(configs, fallback.TLSConfig)
+	}
+
+	for _, tlsConfig := range configs {
+		if tlsConfig == nil {
+			continue
+		}
+		if c.ServerNameOverride != "" {
+			tlsConfig.ServerName = c.ServerNameOverride
+		}
+		if minVersion != 0 {
+			tlsConfig.MinVersion = minVersion
+		}
+	}
+
+	return nil
+}
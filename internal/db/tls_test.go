@@ -0,0 +1,187 @@
+package db
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// Issues a certificate for the name, usable by servers and clients
+func (ca *testCA) issue(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) string {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600))
+	return path
+}
+
+// Completes a TLS handshake with a server requiring client certificates, returning the client certificate name
+func handshake(t *testing.T, server tls.Certificate, ca *testCA, client *tls.Config) (string, error) {
+	t.Helper()
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{server},
+		ClientCAs:    ca.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	require.NoError(t, err)
+	defer listener.Close()
+
+	names := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			names <- ""
+			return
+		}
+		defer conn.Close()
+
+		tlsConn := conn.(*tls.Conn)
+		if err := tlsConn.Handshake(); err != nil {
+			names <- ""
+			return
+		}
+		names <- tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), client)
+	if err != nil {
+		<-names
+		return "", err
+	}
+	defer conn.Close()
+
+	return <-names, nil
+}
+
+func TestParseConfigTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	server := ca.issue(t, "db.internal")
+	client := ca.issue(t, "otel")
+
+	clientKey, err := x509.MarshalPKCS8PrivateKey(client.PrivateKey)
+	require.NoError(t, err)
+
+	tlsConfig := TLSConfig{
+		CAFile:             writePEM(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", ca.cert.Raw),
+		CertFile:           writePEM(t, filepath.Join(dir, "client.pem"), "CERTIFICATE", client.Certificate[0]),
+		KeyFile:            writePEM(t, filepath.Join(dir, "client-key.pem"), "PRIVATE KEY", clientKey),
+		ServerNameOverride: "db.internal",
+		MinVersion:         "1.3",
+	}
+
+	for _, connString := range []string{
+		URL("127.0.0.1", 5432, "otel", "secret", "otel", "verify-full"),
+		"host=127.0.0.1 user=otel dbname=otel sslmode=verify-full",
+	} {
+		t.Run(connString, func(t *testing.T) {
+			config, err := ParseConfig(connString, tlsConfig)
+			require.NoError(t, err)
+			require.NotNil(t, config.TLSConfig)
+			assert.Equal(t, "db.internal", config.TLSConfig.ServerName)
+			assert.Equal(t, uint16(tls.VersionTLS13), config.TLSConfig.MinVersion)
+
+			name, err := handshake(t, server, ca, config.TLSConfig)
+			require.NoError(t, err)
+			assert.Equal(t, "otel", name)
+
+			// Without the override the server name is the host, which the certificate isn't issued for
+			withoutOverride := tlsConfig
+			withoutOverride.ServerNameOverride = ""
+			config, err = ParseConfig(connString, withoutOverride)
+			require.NoError(t, err)
+			_, err = handshake(t, server, ca, config.TLSConfig)
+			assert.Error(t, err)
+		})
+	}
+
+	// A server certificate from another CA is rejected
+	_, err = func() (string, error) {
+		config, err := ParseConfig(URL("127.0.0.1", 5432, "otel", "secret", "otel", "verify-ca"), tlsConfig)
+		require.NoError(t, err)
+		return handshake(t, newTestCA(t).issue(t, "db.internal"), ca, config.TLSConfig)
+	}()
+	assert.Error(t, err)
+}
+
+func TestParseConfigTLSErrors(t *testing.T) {
+	url := URL("localhost", 5432, "otel", "secret", "otel", "verify-full")
+
+	_, err := ParseConfig(url, TLSConfig{MinVersion: "1.4"})
+	assert.ErrorContains(t, err, `unknown TLS min_version "1.4"`)
+
+	_, err = ParseConfig(url, TLSConfig{CertFile: filepath.Join(t.TempDir(), "client.pem")})
+	assert.ErrorContains(t, err, `both "sslcert" and "sslkey" are required`)
+
+	_, err = ParseConfig(url, TLSConfig{CAFile: filepath.Join(t.TempDir(), "missing.pem")})
+	assert.ErrorContains(t, err, "unable to read CA file")
+
+	// TLS settings don't apply without TLS
+	config, err := ParseConfig(URL("localhost", 5432, "otel", "secret", "otel", "disable"), TLSConfig{MinVersion: "1.3"})
+	require.NoError(t, err)
+	assert.Nil(t, config.TLSConfig)
+}
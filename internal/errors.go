@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"go.opentelemetry.io/collector/consumer/consumererror"
+)
+
+// SQLSTATE classes of errors that may go away when the same data is written again
+// https://www.postgresql.org/docs/current/errcodes-appendix.html
+var retryableSQLStateClasses = map[string]struct{}{
+	"08": {}, // connection exception
+	"40": {}, // transaction rollback, e.g. serialization failure or deadlock
+	"53": {}, // insufficient resources
+	"55": {}, // object not in prerequisite state, e.g. lock not available
+	"57": {}, // operator intervention, e.g. admin shutdown or statement timeout
+	"58": {}, // system error
+}
+
+// Errors of tables and columns changed outside of the exporter. The failed metric is forgotten
+// by the cache, so the next attempt creates what is missing.
+var retryableSQLStates = map[string]struct{}{
+	"42P01": {}, // undefined_table
+	"42703": {}, // undefined_column
+}
+
+// ClassifyError marks an error as permanent unless writing the same data again may succeed.
+// Database errors are classified by their SQLSTATE. Of the other errors only connection, network and
+// context failures are retryable, errors like values pgx can't encode fail the same way every time.
+func ClassifyError(err error) error {
+	if err == nil || consumererror.IsPermanent(err) || isRetryable(err) {
+		return err
+	}
+
+	return consumererror.NewPermanent(err)
+}
+
+func isRetryable(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		if _, present := retryableSQLStates[pgErr.Code]; present {
+			return true
+		}
+
+		_, present := retryableSQLStateClasses[pgErr.Code[:min(2, len(pgErr.Code))]]
+		return present
+	}
+
+	return isConnectionError(err)
+}
+
+// Errors of connections that failed or were lost, and of operations cut short by their context
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	var connectErr *pgconn.ConnectError
+
+	return pgconn.SafeToRetry(err) || pgconn.Timeout(err) ||
+		errors.As(err, &netErr) || errors.As(err, &connectErr) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
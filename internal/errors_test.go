@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/consumer/consumererror"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		permanent bool
+	}{
+		{name: "connection failure", err: &pgconn.PgError{Code: "08006"}},
+		{name: "deadlock", err: &pgconn.PgError{Code: "40P01"}},
+		{name: "serialization failure", err: &pgconn.PgError{Code: "40001"}},
+		{name: "disk full", err: &pgconn.PgError{Code: "53100"}},
+		{name: "lock not available", err: &pgconn.PgError{Code: "55P03"}},
+		{name: "admin shutdown", err: &pgconn.PgError{Code: "57P01"}},
+		{name: "undefined table", err: &pgconn.PgError{Code: "42P01"}},
+		{name: "undefined column", err: fmt.Errorf("insert: %w", &pgconn.PgError{Code: "42703"})},
+		{name: "network error", err: fmt.Errorf("insert: %w", &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET})},
+		{name: "connect error", err: &pgconn.ConnectError{Config: &pgconn.Config{}}},
+		{name: "unexpected EOF", err: fmt.Errorf("copy: %w", io.ErrUnexpectedEOF)},
+		{name: "closed connection", err: fmt.Errorf("query: %w", net.ErrClosed)},
+		{name: "bad connection", err: driver.ErrBadConn},
+		{name: "connection done", err: sql.ErrConnDone},
+		{name: "deadline exceeded", err: fmt.Errorf("insert: %w", context.DeadlineExceeded)},
+		{name: "canceled", err: context.Canceled},
+		{name: "encode error", err: errors.New("failed to encode args[3]: unable to encode 1.5 into binary format for int8"), permanent: true},
+		{name: "marshal error", err: fmt.Errorf("marshal attributes: %w", &json.UnsupportedValueError{Str: "NaN"}), permanent: true},
+		{name: "invalid value", err: &pgconn.PgError{Code: "22P02"}, permanent: true},
+		{name: "not null violation", err: &pgconn.PgError{Code: "23502"}, permanent: true},
+		{name: "insufficient privilege", err: fmt.Errorf("create: %w", &pgconn.PgError{Code: "42501"}), permanent: true},
+		{name: "already permanent", err: consumererror.NewPermanent(errors.New("bad data")), permanent: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ClassifyError(tt.err)
+			assert.ErrorIs(t, err, tt.err)
+			assert.Equal(t, tt.permanent, consumererror.IsPermanent(err))
+		})
+	}
+
+	assert.NoError(t, ClassifyError(nil))
+}
@@ -0,0 +1,85 @@
+package internal
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// MaintenanceTask is a named piece of periodic housekeeping, e.g. managing partitions
+type MaintenanceTask struct {
+	Name string
+	Run  func(ctx context.Context) error
+	// Run the task in the background as soon as the maintainer starts instead of
+	// waiting for the first interval
+	Immediate bool
+}
+
+// Maintainer runs maintenance tasks in the background on a fixed interval
+// until it's shut down. Failing tasks are logged and retried on the next tick.
+type Maintainer struct {
+	logger   *zap.Logger
+	interval time.Duration
+	tasks    []MaintenanceTask
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewMaintainer(logger *zap.Logger, interval time.Duration, tasks ...MaintenanceTask) *Maintainer {
+	return &Maintainer{
+		logger:   logger,
+		interval: interval,
+		tasks:    tasks,
+	}
+}
+
+// Start launches the background loop. It does nothing if there are no tasks.
+func (m *Maintainer) Start() {
+	if len(m.tasks) == 0 || m.interval <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+
+		m.runTasks(ctx, true)
+
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				m.runTasks(ctx, false)
+			}
+		}
+	}()
+}
+
+// Shutdown stops the background loop and waits for running tasks to finish
+func (m *Maintainer) Shutdown() {
+	if m.cancel != nil {
+		m.cancel()
+	}
+	m.wg.Wait()
+}
+
+func (m *Maintainer) runTasks(ctx context.Context, immediateOnly bool) {
+	for _, task := range m.tasks {
+		if immediateOnly && !task.Immediate {
+			continue
+		}
+		if err := task.Run(ctx); err != nil && ctx.Err() == nil {
+			m.logger.Warn("maintenance task failed", zap.String("task", task.Name), zap.Error(err))
+		}
+	}
+}
@@ -3,72 +3,71 @@ package internal
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"slices"
 	"strings"
+	"time"
 
+	"github.com/destrex271/postgresexporter/internal/db"
+	"github.com/jackc/pgx/v5"
 	"go.opentelemetry.io/collector/pdata/pcommon"
 	"go.opentelemetry.io/collector/pdata/pmetric"
 	conventions "go.opentelemetry.io/collector/semconv/v1.27.0"
-	"go.uber.org/zap"
 )
 
 // https://developers.cloudflare.com/analytics/analytics-engine/sql-api/#table-structure
 const (
-	// TODO: move it to the exporter config and make configurable
-	maxAttributesNumber = 20
-
 	timestampMetricTableColumnName = "timestamp"
 
+	metricsMigrationTarget = "metrics"
+
+	// Applies an ALTER TABLE action to every registered metric table matching the condition
+	alterRegisteredMetricTablesSQL = `
+	DO $$
+	DECLARE
+		t regclass;
+	BEGIN
+		FOR t IN SELECT to_regclass(%[2]s || '.' || quote_ident(name)) FROM %[1]s LOOP
+			IF t IS NOT NULL THEN
+				EXECUTE format('ALTER TABLE %%s %[3]s', t);
+			END IF;
+		END LOOP;
+	END
+	$$
+	`
+
+	// Registered metric tables lacking attribute1 or extra_attributes
+	listMetricTablesWithoutAttributeColumnsSQL = `
+	SELECT r.name
+	FROM %[1]s r
+	WHERE to_regclass(%[2]s || '.' || quote_ident(r.name)) IS NOT NULL AND (
+		SELECT count(*)
+		FROM pg_attribute a
+		WHERE a.attrelid = to_regclass(%[2]s || '.' || quote_ident(r.name))
+			AND a.attname IN ('attribute1', 'extra_attributes') AND NOT a.attisdropped
+	) < 2
+	ORDER BY r.name
+	`
+
+	createAttributesGINIndexSQL = `CREATE INDEX IF NOT EXISTS %s ON %s USING GIN (attributes)`
+
 	timescaleDBSpecificMetricTableQuery = `
-	SELECT create_hypertable('%s.%s', by_range('%s'), migrate_data => true, if_not_exists => true);
+	SELECT create_hypertable(%s, by_range(%s), migrate_data => true, if_not_exists => true);
 	`
 )
 
 var (
-	postgreSQLBaseMetricTableColumns = []string{
-		"resource_url             VARCHAR",
-		"resource_attributes      JSONB",
-		"scope_name               VARCHAR",
-    	"scope_version            VARCHAR",
-    	"scope_attributes         JSONB",
-    	"scope_dropped_attr_count INTEGER",
-    	"scope_url                VARCHAR",
-    	"service_name             VARCHAR",
-
-		"name        VARCHAR NOT NULL",
-		"type        INTEGER",
-		"description VARCHAR",
-		"unit        VARCHAR",
+	// Followed by the attribute columns, "metadata" and the columns of the metric type
+	baseMetricTableInsertColumns = []string{
+		"resource_url", "resource_attributes",
+		"scope_name", "scope_version", "scope_attributes", "scope_dropped_attr_count", "scope_url", "service_name",
+		"name", "type", "description", "unit",
+		"start_timestamp", "timestamp",
+	}
 
-		"start_timestamp TIMESTAMP",
-		"timestamp       TIMESTAMP NOT NULL",
-
-		"attribute1  VARCHAR",
-		"attribute2  VARCHAR",
-		"attribute3  VARCHAR",
-		"attribute4  VARCHAR",
-		"attribute5  VARCHAR",
-		"attribute6  VARCHAR",
-		"attribute7  VARCHAR",
-		"attribute8  VARCHAR",
-		"attribute9  VARCHAR",
-		"attribute10 VARCHAR",
-		"attribute11 VARCHAR",
-		"attribute12 VARCHAR",
-		"attribute13 VARCHAR",
-		"attribute14 VARCHAR",
-		"attribute15 VARCHAR",
-		"attribute16 VARCHAR",
-		"attribute17 VARCHAR",
-		"attribute18 VARCHAR",
-		"attribute19 VARCHAR",
-		"attribute20 VARCHAR",
-
-		"metadata JSONB",
-	}
-
-	timescaleDBBaseMetricTableColumns = []string{
+	baseMetricTableColumns = []string{
 		"resource_url             VARCHAR",
 		"resource_attributes      JSONB",
 		"scope_name               VARCHAR",
@@ -85,30 +84,11 @@ var (
 
 		"start_timestamp TIMESTAMPTZ",
 		"timestamp       TIMESTAMPTZ NOT NULL",
-
-		"attribute1  VARCHAR",
-		"attribute2  VARCHAR",
-		"attribute3  VARCHAR",
-		"attribute4  VARCHAR",
-		"attribute5  VARCHAR",
-		"attribute6  VARCHAR",
-		"attribute7  VARCHAR",
-		"attribute8  VARCHAR",
-		"attribute9  VARCHAR",
-		"attribute10 VARCHAR",
-		"attribute11 VARCHAR",
-		"attribute12 VARCHAR",
-		"attribute13 VARCHAR",
-		"attribute14 VARCHAR",
-		"attribute15 VARCHAR",
-		"attribute16 VARCHAR",
-		"attribute17 VARCHAR",
-		"attribute18 VARCHAR",
-		"attribute19 VARCHAR",
-		"attribute20 VARCHAR",
-
-		"metadata JSONB",
 	}
+
+	// Nanoseconds since the Unix epoch, which TIMESTAMPTZ rounds to microseconds
+	unixNanoMetricTableInsertColumns = []string{"start_time_unix_nano", "time_unix_nano"}
+	unixNanoMetricTableColumns       = []string{"start_time_unix_nano BIGINT", "time_unix_nano BIGINT"}
 )
 
 // MetricsGroup is used to group metric data and insert into Postgres.
@@ -118,9 +98,9 @@ type MetricsGroup interface {
 	Add(resMetadata *ResourceMetadata, metric any, name, description, unit string, metadata pcommon.Map) error
 
 	// Creates metric table
-	createTable(ctx context.Context, client *sql.DB, metricName string) error
-	// Inserts metric data to db
-	insert(ctx context.Context, client *sql.DB) error
+	createTable(ctx context.Context, client *sql.DB, tableName string) error
+	// Inserts metric data to db, recording the metrics and data points that failed
+	insert(ctx context.Context, client *sql.DB, failures *metricsFailures)
 	// Return metrics names
 	getMetricsNames() []string
 }
@@ -132,133 +112,642 @@ type ResourceMetadata struct {
 	ScopeUrl   string
 }
 
+// MetricsSettings defines how metric tables are created and written
+type MetricsSettings struct {
+	DBType     DBType
+	SchemaName string
+	UseCopy    bool
+
+	// Ignored for TimescaleDB, where metric tables are hypertables
+	Partitioning    PartitioningConfig
+	Retention       time.Duration
+	RetentionByType MetricTypeRetention
+
+	Layout             MetricsLayout
+	AttributesStorage  AttributesStorage
+	AttributesGINIndex bool
+
+	// Maximum number of attribute columns of a metric table, further attributes are stored in "extra_attributes"
+	AttributeColumns         int
+	AttributeColumnsByMetric map[string]int
+
+	// Also write exemplars to the exemplars table
+	ExemplarsTable bool
+	// Store histogram buckets and summary quantiles in native arrays instead of JSONB
+	NativeArrays bool
+	// Also write timestamps as nanoseconds since the Unix epoch
+	UnixNanoTimestamps bool
+
+	// Shared by all batches of an exporter
+	Cache         *MetricsCache
+	SumNormalizer *SumNormalizer
+}
+
+// Returns the attribute columns limit of a metric
+func (s MetricsSettings) attributeColumnsLimit(metricName string) int {
+	if limit, present := s.AttributeColumnsByMetric[metricName]; present {
+		return limit
+	}
+	return s.AttributeColumns
+}
+
+// Returns the retention of the metric tables of a type
+func (s MetricsSettings) retention(metricsType pmetric.MetricType) time.Duration {
+	var retention time.Duration
+	switch metricsType {
+	case pmetric.MetricTypeGauge:
+		retention = s.RetentionByType.Gauge
+	case pmetric.MetricTypeSum:
+		retention = s.RetentionByType.Sum
+	case pmetric.MetricTypeHistogram:
+		retention = s.RetentionByType.Histogram
+	case pmetric.MetricTypeExponentialHistogram:
+		retention = s.RetentionByType.ExponentialHistogram
+	case pmetric.MetricTypeSummary:
+		retention = s.RetentionByType.Summary
+	}
+
+	if retention > 0 {
+		return retention
+	}
+	return s.Retention
+}
+
+// Metric tables need retention enforcement if any type has a retention
+func (s MetricsSettings) hasRetention() bool {
+	r := s.RetentionByType
+	return s.Retention > 0 || r.Gauge > 0 || r.Sum > 0 || r.Histogram > 0 || r.ExponentialHistogram > 0 || r.Summary > 0
+}
+
+// Exemplars are kept as long as the data points of any type with exemplars, zero keeps them forever
+func (s MetricsSettings) exemplarsRetention() time.Duration {
+	var result time.Duration
+	for _, metricsType := range []pmetric.MetricType{
+		pmetric.MetricTypeGauge, pmetric.MetricTypeSum, pmetric.MetricTypeHistogram, pmetric.MetricTypeExponentialHistogram,
+	} {
+		retention := s.retention(metricsType)
+		if retention == 0 {
+			return 0
+		}
+		result = max(result, retention)
+	}
+
+	return result
+}
+
+// Returns the type of a column holding an array, arrayType with native arrays and JSONB otherwise
+func (s MetricsSettings) arrayColumnType(arrayType string) string {
+	if s.NativeArrays {
+		return arrayType
+	}
+	return "JSONB"
+}
+
+// Returns the insert columns of a metric table, followed by the unix nano timestamps if enabled
+func (s MetricsSettings) insertColumns(attributes metricAttributes, valueColumns []string) []string {
+	columns := metricTableInsertColumns(attributes, valueColumns)
+	if s.UnixNanoTimestamps {
+		return slices.Concat(columns, unixNanoMetricTableInsertColumns)
+	}
+	return columns
+}
+
+// Appends the unix nano timestamps to a row of a metric table if enabled
+func (s MetricsSettings) appendUnixNano(row []any, start, timestamp pcommon.Timestamp) []any {
+	if s.UnixNanoTimestamps {
+		return append(row, int64(start), int64(timestamp))
+	}
+	return row
+}
+
+// Metric tables are only partitioned natively on plain PostgreSQL
+func (s MetricsSettings) partitioned() bool {
+	return s.DBType != DBTypeTimescaleDB && s.Partitioning.Enabled()
+}
+
 // NewMetricsModel create a model for contain different metric data
-func NewMetricsGroupMap(dbtype DBType, schemaName string) map[pmetric.MetricType]MetricsGroup {
+func NewMetricsGroupMap(settings MetricsSettings) map[pmetric.MetricType]MetricsGroup {
 	return map[pmetric.MetricType]MetricsGroup{
-		pmetric.MetricTypeGauge: &gaugeMetricsGroup{MetricsType: pmetric.MetricTypeGauge, DBType: dbtype, SchemaName: schemaName},
-		pmetric.MetricTypeSum: &sumMetricsGroup{MetricsType: pmetric.MetricTypeSum, DBType: dbtype, SchemaName: schemaName},
-		pmetric.MetricTypeHistogram: &histogramMetricsGroup{MetricsType: pmetric.MetricTypeHistogram, DBType: dbtype, SchemaName: schemaName},
-		pmetric.MetricTypeExponentialHistogram: &expHistogramMetricsGroup{MetricsType: pmetric.MetricTypeExponentialHistogram, DBType: dbtype, SchemaName: schemaName},
-		pmetric.MetricTypeSummary: &summaryMetricsGroup{MetricsType: pmetric.MetricTypeSummary, DBType: dbtype, SchemaName: schemaName},
+		pmetric.MetricTypeGauge: &gaugeMetricsGroup{MetricsType: pmetric.MetricTypeGauge, MetricsSettings: settings},
+		pmetric.MetricTypeSum: &sumMetricsGroup{MetricsType: pmetric.MetricTypeSum, MetricsSettings: settings},
+		pmetric.MetricTypeHistogram: &histogramMetricsGroup{MetricsType: pmetric.MetricTypeHistogram, MetricsSettings: settings},
+		pmetric.MetricTypeExponentialHistogram: &expHistogramMetricsGroup{MetricsType: pmetric.MetricTypeExponentialHistogram, MetricsSettings: settings},
+		pmetric.MetricTypeSummary: &summaryMetricsGroup{MetricsType: pmetric.MetricTypeSummary, MetricsSettings: settings},
 	}
 }
 
-// Inserts metrics data
-func InsertMetrics(ctx context.Context, client *sql.DB, metricsGroupMap map[pmetric.MetricType]MetricsGroup) error {
-	var errs error
+// MigrateMetrics brings the objects shared by all metric tables in the schema to the latest version
+func MigrateMetrics(ctx context.Context, client *sql.DB, schemaName string) error {
+	return Migrate(ctx, client, logger, schemaName, metricsMigrationTarget, metricsMigrations(schemaName))
+}
 
-	for _, m := range metricsGroupMap {
-		errs = errors.Join(errs, m.insert(ctx, client))
+// CheckMetricsSchemaVersion fails if the objects shared by all metric tables were migrated by a newer exporter
+func CheckMetricsSchemaVersion(ctx context.Context, client *sql.DB, schemaName string) error {
+	return CheckSchemaVersion(ctx, client, schemaName, metricsMigrationTarget, metricsMigrations(schemaName))
+}
+
+// Versioned changes of the objects shared by all metric tables. Append new versions, never edit applied ones.
+// The create statements always render the latest layout, so later versions must be
+// no-ops on freshly created objects.
+func metricsMigrations(schemaName string) []Migration {
+	return []Migration{
+		{
+			Version:     1,
+			Description: "create attributes mapping table",
+			Up:          ExecMigration(renderCreateAttributesMappingTableSQL(schemaName)),
+		},
+		{
+			Version:     2,
+			Description: "create metric tables registry",
+			Up: ExecMigration(
+				renderCreateMetricTablesRegistrySQL(schemaName),
+				fmt.Sprintf(backfillMetricTablesRegistrySQL,
+					QuoteIdentifier(schemaName, MetricTablesRegistryTableName),
+					QuoteIdentifier(schemaName, AttributesMappingTableName),
+					QuoteLiteral(QuoteIdentifier(schemaName))),
+			),
+		},
+		{
+			Version:     3,
+			Description: "add extra_attributes to metric tables",
+			Up: ExecMigration(renderAlterRegisteredMetricTablesSQL(schemaName, "ADD COLUMN IF NOT EXISTS extra_attributes JSONB")),
+		},
+		{
+			Version:     4,
+			Description: "create quantile functions",
+			Up:          ExecMigration(renderCreateQuantileFunctionsSQL(schemaName)...),
+		},
+		{
+			Version:     5,
+			Description: "store metric timestamps as TIMESTAMPTZ",
+			Up: func(ctx context.Context, tx *sql.Tx) error {
+				return convertMetricTimestampColumns(ctx, tx, schemaName)
+			},
+		},
 	}
+}
 
-	return errs
+// Renders a statement applying the ALTER TABLE action to every registered metric table.
+// The action is inserted into a string literal, so it must not contain quotes.
+func renderAlterRegisteredMetricTablesSQL(schemaName, action string) string {
+	return fmt.Sprintf(alterRegisteredMetricTablesSQL,
+		QuoteIdentifier(schemaName, MetricTablesRegistryTableName), QuoteLiteral(QuoteIdentifier(schemaName)), action)
 }
 
-func getBaseMetricTableColumns(dbtype DBType) []string {
-	var tableColumns []string
-	switch (dbtype) {
-	case DBTypeTimescaleDB:
-		tableColumns = timescaleDBBaseMetricTableColumns
-	default:
-		tableColumns = postgreSQLBaseMetricTableColumns
+// Converts the timestamps of the registered metric tables and the exemplars table to TIMESTAMPTZ.
+// TimescaleDB tables have TIMESTAMPTZ columns already.
+func convertMetricTimestampColumns(ctx context.Context, tx *sql.Tx, schemaName string) error {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(`SELECT name FROM %s ORDER BY name`, QuoteIdentifier(schemaName, MetricTablesRegistryTableName)))
+	if err != nil {
+		return err
+	}
+
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			rows.Close()
+			return err
+		}
+		tables = append(tables, table)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, table := range tables {
+		err := ConvertTimestampColumns(ctx, tx, logger, schemaName, table, []string{"start_timestamp", timestampMetricTableColumnName}, nil, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return ConvertTimestampColumns(ctx, tx, logger, schemaName, ExemplarsTableName, []string{timestampMetricTableColumnName}, nil, nil)
+}
+
+// PrepareMetricTables adapts the existing metric tables to the configured attributes and array storage,
+// tables created afterwards get the right columns already. Also creates the exemplars table if enabled.
+func PrepareMetricTables(ctx context.Context, client *sql.DB, settings MetricsSettings) error {
+	if settings.AttributesStorage == AttributesStorageJSONB {
+		_, err := client.ExecContext(ctx, renderAlterRegisteredMetricTablesSQL(settings.SchemaName, "ADD COLUMN IF NOT EXISTS attributes JSONB"))
+		if err != nil {
+			return err
+		}
+	} else if err := addMissingAttributeColumns(ctx, client, settings.SchemaName); err != nil {
+		return err
+	}
+
+	if settings.UnixNanoTimestamps {
+		_, err := client.ExecContext(ctx, renderAlterRegisteredMetricTablesSQL(settings.SchemaName,
+			"ADD COLUMN IF NOT EXISTS start_time_unix_nano BIGINT, ADD COLUMN IF NOT EXISTS time_unix_nano BIGINT"))
+		if err != nil {
+			return err
+		}
+	}
+
+	if settings.ExemplarsTable {
+		return createExemplarsTable(ctx, client, settings)
 	}
 
-	return tableColumns
+	return nil
 }
 
-func createMetricTable(ctx context.Context, client *sql.DB, schemaName, metricName string, tableColumns []string, dbtype DBType) error {
-	query := fmt.Sprintf(createTableIfNotExistsSQL, schemaName, metricName, strings.Join(tableColumns, ","))
-	_, err := client.ExecContext(ctx, query)
+// Tables created with JSONB storage have none of the columns a mapping starts with. Only the registered tables
+// missing them are altered, so switching back to columns storage doesn't lock every table on each start.
+func addMissingAttributeColumns(ctx context.Context, client *sql.DB, schemaName string) error {
+	rows, err := client.QueryContext(ctx, fmt.Sprintf(listMetricTablesWithoutAttributeColumnsSQL,
+		QuoteIdentifier(schemaName, MetricTablesRegistryTableName), QuoteLiteral(QuoteIdentifier(schemaName))))
 	if err != nil {
-		return fmt.Errorf("failed creating schema: %w", err)
+		return err
 	}
 
-	executeSpecificMetricTableQuery(ctx, client, schemaName, metricName, dbtype)
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			rows.Close()
+			return err
+		}
+		tables = append(tables, table)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	actions := make([]string, 0, defaultAttributeColumnsNumber+1)
+	for _, column := range attributeColumnDefinitions(defaultAttributeColumnsNumber) {
+		actions = append(actions, "ADD COLUMN IF NOT EXISTS "+column)
+	}
+	actions = append(actions, "ADD COLUMN IF NOT EXISTS extra_attributes JSONB")
+
+	for _, table := range tables {
+		query := fmt.Sprintf("ALTER TABLE %s %s", QuoteIdentifier(schemaName, table), strings.Join(actions, ", "))
+		if _, err := client.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("failed adding attribute columns to %s: %w", table, err)
+		}
+	}
 
 	return nil
 }
 
-// Constructs and executes a database-specific query for a given metric table.
-// For example, if the dbtype is TimescaleDB it creates hypertable.
-func executeSpecificMetricTableQuery(ctx context.Context, client *sql.DB, schemaName, metricName string, dbtype DBType) error {
-	var specificMetricTableQuery string
-	switch (dbtype) {
-	case DBTypeTimescaleDB:
-		specificMetricTableQuery = fmt.Sprintf(timescaleDBSpecificMetricTableQuery,
-			schemaName, metricName, timestampMetricTableColumnName)
-	default:
-		specificMetricTableQuery = ""
+// MaintainMetricPartitions keeps the partitions of every registered partitioned metric table up to date
+func MaintainMetricPartitions(ctx context.Context, client *sql.DB, settings MetricsSettings, now time.Time) error {
+	if !settings.partitioned() {
+		return nil
 	}
 
-	if specificMetricTableQuery != "" {
-		_, err := client.ExecContext(ctx, specificMetricTableQuery)
+	tables, err := getRegisteredMetricTables(ctx, client, settings.SchemaName)
+	if err != nil {
+		return err
+	}
+
+	var errs error
+	for _, table := range tables {
+		partitioned, err := IsPartitioned(ctx, client, settings.SchemaName, table.name)
 		if err != nil {
-			logger.Warn("failed to execute specific metric table query", zap.String("dbtype", metricName), zap.Any("dbtype", dbtype))
+			errs = errors.Join(errs, err)
+			continue
+		}
+
+		if partitioned {
+			errs = errors.Join(errs, MaintainPartitions(ctx, client, settings.SchemaName, table.name, settings.Partitioning, now))
 		}
 	}
 
-	return nil
+	return errs
 }
 
-func getServiceName(resAttr pcommon.Map) string {
-	var serviceName string
-	if v, ok := resAttr.Get(conventions.AttributeServiceName); ok {
-		serviceName = v.AsString()
+// EnforceMetricsRetention removes expired data points from every registered metric table
+// according to the retention of its metric type
+func EnforceMetricsRetention(ctx context.Context, client *sql.DB, settings MetricsSettings, now time.Time) error {
+	if !settings.hasRetention() {
+		return nil
 	}
 
-	return serviceName
+	tables, err := getRegisteredMetricTables(ctx, client, settings.SchemaName)
+	if err != nil {
+		return err
+	}
+
+	var partitioning PartitioningConfig
+	if settings.partitioned() {
+		partitioning = settings.Partitioning
+	}
+
+	var errs error
+	enforce := func(tableName string, partitioning PartitioningConfig, retention time.Duration) {
+		if retention <= 0 {
+			return
+		}
+
+		// Metric tables are created while exporting, so they're indexed here rather than on startup
+		err := EnsureTimestampIndex(ctx, client, settings.DBType, settings.SchemaName, tableName, timestampMetricTableColumnName)
+		if err != nil {
+			errs = errors.Join(errs, err)
+			return
+		}
+
+		errs = errors.Join(errs, EnforceRetention(ctx, client, settings.DBType, settings.SchemaName, tableName,
+			timestampMetricTableColumnName, partitioning, retention, now))
+	}
+
+	for _, table := range tables {
+		enforce(table.name, partitioning, settings.retention(table.metricsType))
+	}
+
+	if settings.ExemplarsTable {
+		enforce(ExemplarsTableName, PartitioningConfig{}, settings.exemplarsRetention())
+	}
+
+	return errs
 }
 
-func checkAttributesNumber(attrs pcommon.Map) error {
-	if attrs.Len() > maxAttributesNumber {
-		return fmt.Errorf("max attributes number exceeded")
+// Inserts metrics data. Each metric is written completely or not at all. If some metrics fail,
+// the returned error is a consumererror.Metrics with the ones worth retrying, or permanent if there are none.
+func InsertMetrics(ctx context.Context, client *sql.DB, metricsGroupMap map[pmetric.MetricType]MetricsGroup) error {
+	failures := newMetricsFailures()
+
+	for _, m := range metricsGroupMap {
+		m.insert(ctx, client, failures)
 	}
 
-	return nil
+	return failures.err()
 }
 
-func getAttributesAsSliceAndCheckIfUpdated(attrs pcommon.Map, attributesMapping *AttributesMapping) ([]*string, bool, error) {
-	err := checkAttributesNumber(attrs)
-	if err != nil {
-		return nil, false, err
+// A metric table known to exist
+type metricTable struct {
+	// Buckets and quantiles are stored as native arrays instead of JSONB. MetricsSettings.NativeArrays
+	// only applies to new tables, existing ones keep the storage they were created with.
+	nativeArrays bool
+	// Number of attributeN columns, from attribute1 on. A mapping can be ahead of the table,
+	// e.g. if adding the columns failed after the mapping grew, so it's read from the table itself.
+	attributeColumns int
+}
+
+// Encodes an array for the array columns of the table. pgx encodes slices as native arrays.
+func (t metricTable) arrayValue(value any) (any, error) {
+	if t.nativeArrays {
+		return value, nil
 	}
+	return json.Marshal(value)
+}
+
+// Column of the tables of a metric type that is JSONB or a native array, depending on how the table stores arrays
+var arrayColumnByType = map[pmetric.MetricType]string{
+	pmetric.MetricTypeHistogram:            "bucket_counts",
+	pmetric.MetricTypeExponentialHistogram: "positive_bucket_counts",
+	pmetric.MetricTypeSummary:              "quantile_values",
+}
 
-	result := make([]*string, maxAttributesNumber)
+const isArrayColumnSQL = `
+SELECT EXISTS (
+	SELECT 1 FROM pg_attribute a JOIN pg_type t ON t.oid = a.atttypid
+	WHERE a.attrelid = to_regclass($1) AND a.attname = $2 AND NOT a.attisdropped AND t.typcategory = 'A'
+)
+`
 
-	attrNameAndPosMap, err := getAttrsNameAndPosMap(attributesMapping)
+// Creates the metric table unless it's known to exist. Returns the table and whether it was created.
+// Existing tables are registered with their type, which tables backfilled into the registry are missing.
+func ensureMetricTable(ctx context.Context, client *sql.DB, g MetricsGroup, settings MetricsSettings, metricsType pmetric.MetricType, tableName string) (metricTable, bool, error) {
+	if table, present := settings.Cache.table(tableName); present {
+		return table, false, nil
+	}
+
+	exists, err := CheckIfTableExists(ctx, client, settings.SchemaName, tableName)
 	if err != nil {
-		return nil, false, err
+		return metricTable{}, false, err
 	}
 
-	updated := false
+	table := metricTable{nativeArrays: settings.NativeArrays}
+	if settings.AttributesStorage != AttributesStorageJSONB {
+		table.attributeColumns = defaultAttributeColumnsNumber
+	}
 
-	attrs.Range(func(k string, v pcommon.Value) bool {
-		attrPos, present := attrNameAndPosMap[k]
-		if !present {
-			attrPos, err = findNextAvailableAttrPos(attributesMapping)
+	if exists {
+		if err := registerMetricTable(ctx, client, settings.SchemaName, tableName, metricsType); err != nil {
+			return metricTable{}, false, fmt.Errorf("failed registering metric table: %w", err)
+		}
+
+		if column, present := arrayColumnByType[metricsType]; present {
+			err := client.QueryRowContext(ctx, isArrayColumnSQL, QuoteIdentifier(settings.SchemaName, tableName), column).Scan(&table.nativeArrays)
 			if err != nil {
-				return false
+				return metricTable{}, false, fmt.Errorf("failed checking array storage of metric table: %w", err)
 			}
+		}
 
-			err = setAttrValueByPos(attributesMapping, attrPos, k)
+		if settings.AttributesStorage != AttributesStorageJSONB {
+			table.attributeColumns, err = countAttributeColumns(ctx, client, settings.SchemaName, tableName)
 			if err != nil {
-				return false
+				return metricTable{}, false, fmt.Errorf("failed reading attribute columns of metric table: %w", err)
 			}
+		}
+	} else {
+		if err := g.createTable(ctx, client, tableName); err != nil {
+			return metricTable{}, false, err
+		}
+	}
+
+	settings.Cache.addTable(tableName, table)
+	return table, !exists, nil
+}
 
-			updated = true
+// Rows to write into a table of the schema
+type tableRows struct {
+	table   string
+	columns []string
+	rows    [][]any
+}
+
+// Writes data point rows into metric tables, e.g. a metric table and the exemplars table, in one transaction.
+// With useCopy the rows of each table are sent in a single COPY, otherwise one INSERT per row is executed.
+func writeMetricRows(ctx context.Context, client *sql.DB, schemaName string, useCopy bool, tables ...tableRows) error {
+	tables = slices.DeleteFunc(tables, func(t tableRows) bool {
+		return len(t.rows) == 0
+	})
+	if len(tables) == 0 {
+		return nil
+	}
+
+	if useCopy {
+		copies := make([]db.CopyRows, len(tables))
+		for i, t := range tables {
+			copies[i] = db.CopyRows{Table: pgx.Identifier{schemaName, t.table}, Columns: t.columns, Rows: t.rows}
 		}
 
-		value := v.AsString()
-		result[attrPos-1] = &value
+		_, err := db.CopyFromAll(ctx, client, copies...)
+		return err
+	}
 
-		return true
+	return db.DoWithTx(ctx, client, func(tx *sql.Tx) error {
+		for _, t := range tables {
+			if err := insertTableRows(ctx, tx, schemaName, t); err != nil {
+				return err
+			}
+		}
+
+		return nil
 	})
+}
 
+func insertTableRows(ctx context.Context, tx *sql.Tx, schemaName string, t tableRows) error {
+	statement, err := tx.PrepareContext(ctx, RenderInsertSQL(QuoteIdentifier(schemaName, t.table), t.columns))
 	if err != nil {
-		return nil, false, err
+		return err
+	}
+
+	defer func() {
+		_ = statement.Close()
+	}()
+
+	for _, row := range t.rows {
+		if _, err := statement.ExecContext(ctx, row...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func getBaseMetricTableColumns(settings MetricsSettings) []string {
+	tableColumns := baseMetricTableColumns
+	if settings.UnixNanoTimestamps {
+		tableColumns = slices.Concat(tableColumns, unixNanoMetricTableColumns)
+	}
+
+	var attributesColumns []string
+	switch settings.AttributesStorage {
+	case AttributesStorageJSONB:
+		attributesColumns = []string{"attributes JSONB"}
+	default:
+		attributesColumns = append(attributeColumnDefinitions(defaultAttributeColumnsNumber), "extra_attributes JSONB")
+	}
+
+	return slices.Concat(tableColumns, attributesColumns, []string{"metadata JSONB"})
+}
+
+// Creates the metric table with its indexes, converts it for the database type and registers it in one transaction,
+// so a failure leaves no table that the next attempt would take as complete
+func createMetricTable(ctx context.Context, client *sql.DB, settings MetricsSettings, metricsType pmetric.MetricType, tableName string, tableColumns []string) error {
+	query := fmt.Sprintf(createTableIfNotExistsSQL, QuoteIdentifier(settings.SchemaName, tableName), strings.Join(tableColumns, ","))
+	if settings.partitioned() {
+		query += " " + RenderPartitionByClause(settings.Partitioning, timestampMetricTableColumnName)
 	}
 
-	return result, updated, nil
+	err := db.DoWithTx(ctx, client, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("failed creating metric table: %w", err)
+		}
+
+		// Shared tables are mostly queried by metric name
+		if settings.Layout == MetricsLayoutTablePerType {
+			query := fmt.Sprintf(createMetricNameIndexSQL,
+				QuoteIdentifier(boundedIdentifier(tableName, "_name_timestamp_idx")), QuoteIdentifier(settings.SchemaName, tableName))
+			if _, err := tx.ExecContext(ctx, query); err != nil {
+				return fmt.Errorf("failed creating metric name index: %w", err)
+			}
+		}
+
+		if settings.AttributesStorage == AttributesStorageJSONB && settings.AttributesGINIndex {
+			query := fmt.Sprintf(createAttributesGINIndexSQL,
+				QuoteIdentifier(boundedIdentifier(tableName, "_attributes_idx")), QuoteIdentifier(settings.SchemaName, tableName))
+			if _, err := tx.ExecContext(ctx, query); err != nil {
+				return fmt.Errorf("failed creating attributes index: %w", err)
+			}
+		}
+
+		if err := executeSpecificMetricTableQuery(ctx, tx, settings.SchemaName, tableName, settings.DBType); err != nil {
+			return err
+		}
+
+		if err := registerMetricTable(ctx, tx, settings.SchemaName, tableName, metricsType); err != nil {
+			return fmt.Errorf("failed registering metric table: %w", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Partitions missing after a failure here are created by the partitions maintenance
+	if settings.partitioned() {
+		if err := MaintainPartitions(ctx, client, settings.SchemaName, tableName, settings.Partitioning, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Constructs and executes a database-specific query for a given metric table.
+// For example, if the dbtype is TimescaleDB it creates hypertable.
+func executeSpecificMetricTableQuery(ctx context.Context, client sqlExecutor, schemaName, tableName string, dbtype DBType) error {
+	var specificMetricTableQuery string
+	switch (dbtype) {
+	case DBTypeTimescaleDB:
+		specificMetricTableQuery = fmt.Sprintf(timescaleDBSpecificMetricTableQuery,
+			QuoteLiteral(QuoteIdentifier(schemaName, tableName)), QuoteLiteral(timestampMetricTableColumnName))
+	default:
+		specificMetricTableQuery = ""
+	}
+
+	if specificMetricTableQuery != "" {
+		if _, err := client.ExecContext(ctx, specificMetricTableQuery); err != nil {
+			return fmt.Errorf("failed executing %s specific query on metric table %s: %w", dbtype, tableName, err)
+		}
+	}
+
+	return nil
+}
+
+func getServiceName(resAttr pcommon.Map) string {
+	var serviceName string
+	if v, ok := resAttr.Get(conventions.AttributeServiceName); ok {
+		serviceName = v.AsString()
+	}
+
+	return serviceName
+}
+
+// Assigns attribute columns to the data point attribute keys of a metric and stores the mapping.
+// Columns beyond the ones tables are created with are added to the metric table,
+// also when the metric table was just created for an existing mapping.
+func mapMetricAttributes(ctx context.Context, client *sql.DB, settings MetricsSettings, mappings map[string]AttributesMapping, metricName, tableName string, table metricTable, attrs []pcommon.Map) (AttributesMapping, error) {
+	attrsMapping, present := mappings[metricName]
+	mappedBefore := len(attrsMapping.Attributes)
+	limit := settings.attributeColumnsLimit(metricName)
+
+	// Keys beyond the limit go to "extra_attributes" without touching the stored mapping
+	if keys := attrsMapping.unmappedKeys(attrs); !present || (len(keys) > 0 && mappedBefore < limit) {
+		var err error
+		attrsMapping, err = allocateAttributeColumns(ctx, client, settings.SchemaName, metricName, keys, limit)
+		if err != nil {
+			return AttributesMapping{}, err
+		}
+
+		mappings[metricName] = attrsMapping
+		settings.Cache.setMapping(attrsMapping)
+	}
+
+	// Compared with the columns of the table rather than the mapping loaded before, so columns missing
+	// after a failed write or a crash between growing the mapping and altering the table are added later
+	if len(attrsMapping.Attributes) > table.attributeColumns {
+		if err := addAttributeColumns(ctx, client, settings.SchemaName, tableName, table.attributeColumns+1, len(attrsMapping.Attributes)); err != nil {
+			return AttributesMapping{}, err
+		}
+
+		table.attributeColumns = len(attrsMapping.Attributes)
+		settings.Cache.addTable(tableName, table)
+	}
+
+	return attrsMapping, nil
+}
+
+// Returns the insert columns of a metric table
+func metricTableInsertColumns(attributes metricAttributes, valueColumns []string) []string {
+	return slices.Concat(baseMetricTableInsertColumns, attributes.columns(), []string{"metadata"}, valueColumns)
 }
 
 func getValue(intValue int64, floatValue float64, dataType any) float64 {
@@ -4,124 +4,323 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"reflect"
+	"slices"
 	"strconv"
 	"strings"
+
+	"github.com/destrex271/postgresexporter/internal/db"
+	"go.opentelemetry.io/collector/pdata/pcommon"
 )
 
 const (
 	AttributesMappingTableName = "_attributes_mappings"
 	AttributesMappingAttributeFieldName = "Attribute"
 
+	// Attribute columns are named attribute1, attribute2, ... in both the mapping and the metric tables
+	attributeColumnPrefix = "attribute"
+	// Number of attribute columns metric tables and the mapping table are created with
+	defaultAttributeColumnsNumber = 20
+
 	attributesMappingInsertSQL = `
-	INSERT INTO "%s"."%s" (name) VALUES ($1) ON CONFLICT (name) DO NOTHING
+	INSERT INTO %s (name) VALUES ($1) ON CONFLICT (name) DO NOTHING
+	`
+
+	attributesMappingLockSQL = `
+	SELECT * FROM %s WHERE name = $1 FOR UPDATE
 	`
 
 	attributesMappingUpdateSQL = `
-	UPDATE "%s"."%s"
-		SET attribute1 = $2,   attribute2 = $3,   attribute3 = $4,   attribute4 = $5,   attribute5 = $6,
-			attribute6 = $7,   attribute7 = $8,   attribute8 = $9,   attribute9 = $10,  attribute10 = $11,
-			attribute11 = $12, attribute12 = $13, attribute13 = $14, attribute14 = $15, attribute15 = $16,
-			attribute16 = $17, attribute17 = $18, attribute18 = $19, attribute19 = $20, attribute20 = $21
-		WHERE name = $1
+	UPDATE %s SET %s WHERE name = $1
+	`
+
+	addAttributeColumnSQL = `
+	ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s VARCHAR
+	`
+
+	listColumnsSQL = `
+	SELECT attname FROM pg_attribute WHERE attrelid = to_regclass($1) AND attnum > 0 AND NOT attisdropped
 	`
 )
 
 var (
-	attributesMappingTableColumns = []string{
-		"name VARCHAR PRIMARY KEY",
-
-		"attribute1  VARCHAR",
-		"attribute2  VARCHAR",
-		"attribute3  VARCHAR",
-		"attribute4  VARCHAR",
-		"attribute5  VARCHAR",
-		"attribute6  VARCHAR",
-		"attribute7  VARCHAR",
-		"attribute8  VARCHAR",
-		"attribute9  VARCHAR",
-		"attribute10 VARCHAR",
-		"attribute11 VARCHAR",
-		"attribute12 VARCHAR",
-		"attribute13 VARCHAR",
-		"attribute14 VARCHAR",
-		"attribute15 VARCHAR",
-		"attribute16 VARCHAR",
-		"attribute17 VARCHAR",
-		"attribute18 VARCHAR",
-		"attribute19 VARCHAR",
-		"attribute20 VARCHAR",
-	}
+	attributesMappingTableColumns = slices.Concat(
+		[]string{"name VARCHAR PRIMARY KEY"},
+		attributeColumnDefinitions(defaultAttributeColumnsNumber),
+	)
 )
 
+// AttributesMapping maps the data point attribute keys of a metric to the attribute columns of its table.
+// The key at index i is stored in column attribute<i+1>.
 type AttributesMapping struct {
-	Name string `db:"name"`
-
-	Attribute1  string `db:"attribute1"`
-	Attribute2  string `db:"attribute2"`
-	Attribute3  string `db:"attribute3"`
-	Attribute4  string `db:"attribute4"`
-	Attribute5  string `db:"attribute5"`
-	Attribute6  string `db:"attribute6"`
-	Attribute7  string `db:"attribute7"`
-	Attribute8  string `db:"attribute8"`
-	Attribute9  string `db:"attribute9"`
-	Attribute10 string `db:"attribute10"`
-	Attribute11 string `db:"attribute11"`
-	Attribute12 string `db:"attribute12"`
-	Attribute13 string `db:"attribute13"`
-	Attribute14 string `db:"attribute14"`
-	Attribute15 string `db:"attribute15"`
-	Attribute16 string `db:"attribute16"`
-	Attribute17 string `db:"attribute17"`
-	Attribute18 string `db:"attribute18"`
-	Attribute19 string `db:"attribute19"`
-	Attribute20 string `db:"attribute20"`
+	Name string
+
+	Attributes []string
 }
 
-func CreateAttributesMappingTable(ctx context.Context, client *sql.DB, schemaName string) error {
-	query := fmt.Sprintf(createTableIfNotExistsSQL,
-		schemaName, AttributesMappingTableName, strings.Join(attributesMappingTableColumns, ","),
-	)
-	_, err := client.ExecContext(ctx, query)
+// Returns the column position of every mapped key, starting at 1
+func (am *AttributesMapping) positions() map[string]int {
+	result := make(map[string]int, len(am.Attributes))
+	for i, key := range am.Attributes {
+		if key != "" {
+			result[key] = i + 1
+		}
+	}
+
+	return result
+}
+
+// Splits data point attributes into values ordered as the attribute columns and
+// the JSON encoded attributes without a column, which is nil if all of them have one
+func (am *AttributesMapping) split(attrs pcommon.Map) ([]any, []byte, error) {
+	values := make([]any, len(am.Attributes))
+	positions := am.positions()
+	extra := pcommon.NewMap()
+
+	attrs.Range(func(k string, v pcommon.Value) bool {
+		if pos, present := positions[k]; present {
+			values[pos-1] = v.AsString()
+		} else {
+			v.CopyTo(extra.PutEmpty(k))
+		}
+
+		return true
+	})
+
+	if extra.Len() == 0 {
+		return values, nil, nil
+	}
+
+	extraAttrs, err := MarshalAttributes(extra)
 	if err != nil {
-		return fmt.Errorf("failed creating attribute mapping table: %w", err)
+		return nil, nil, err
 	}
 
-	return nil
+	return values, extraAttrs, nil
+}
+
+// Returns the attribute keys of the data points without a column, in the order they're first seen
+func (am *AttributesMapping) unmappedKeys(attrs []pcommon.Map) []string {
+	positions := am.positions()
+
+	var result []string
+	for _, a := range attrs {
+		a.Range(func(k string, _ pcommon.Value) bool {
+			if _, present := positions[k]; !present {
+				positions[k] = 0
+				result = append(result, k)
+			}
+
+			return true
+		})
+	}
+
+	return result
 }
 
-func insertAttributesMapping(ctx context.Context, client *sql.DB, schemaName string, attributesMapping *AttributesMapping) error {
-	query := fmt.Sprintf(attributesMappingInsertSQL, schemaName, AttributesMappingTableName)
+// Assigns the next free attribute columns to the keys not mapped yet, as long as
+// the mapping has less than limit columns. Returns whether the mapping grew.
+func (am *AttributesMapping) assign(keys []string, limit int) bool {
+	positions := am.positions()
+	grown := false
+
+	for _, k := range keys {
+		if len(am.Attributes) >= limit {
+			break
+		}
+
+		if _, present := positions[k]; !present {
+			am.Attributes = append(am.Attributes, k)
+			positions[k] = len(am.Attributes)
+			grown = true
+		}
+	}
+
+	return grown
+}
+
+func attributeColumnName(pos int) string {
+	return attributeColumnPrefix + strconv.Itoa(pos)
+}
+
+// Returns the names of the first n attribute columns
+func attributeColumnNames(n int) []string {
+	result := make([]string, n)
+	for i := range result {
+		result[i] = attributeColumnName(i + 1)
+	}
+
+	return result
+}
+
+func attributeColumnDefinitions(n int) []string {
+	result := attributeColumnNames(n)
+	for i := range result {
+		result[i] += " VARCHAR"
+	}
+
+	return result
+}
+
+// Parses the position of an attribute column name, e.g. 3 for attribute3
+func parseAttributeColumnPosition(column string) (int, bool) {
+	suffix, found := strings.CutPrefix(column, attributeColumnPrefix)
+	if !found {
+		return 0, false
+	}
+
+	pos, err := strconv.Atoi(suffix)
+	if err != nil || pos < 1 {
+		return 0, false
+	}
+
+	return pos, true
+}
+
+func renderCreateAttributesMappingTableSQL(schemaName string) string {
+	return fmt.Sprintf(createTableIfNotExistsSQL,
+		QuoteIdentifier(schemaName, AttributesMappingTableName), strings.Join(attributesMappingTableColumns, ","),
+	)
+}
+
+func insertAttributesMapping(ctx context.Context, client sqlExecutor, schemaName string, attributesMapping *AttributesMapping) error {
+	query := fmt.Sprintf(attributesMappingInsertSQL, QuoteIdentifier(schemaName, AttributesMappingTableName))
 	_, err := client.ExecContext(ctx, query, attributesMapping.Name)
 
 	return err
 }
 
-func updateAttributesMapping(ctx context.Context, client *sql.DB, schemaName string, attributesMapping *AttributesMapping) error {
-	query := fmt.Sprintf(attributesMappingUpdateSQL, schemaName, AttributesMappingTableName)
-	args := extractArgs(attributesMapping)
+func updateAttributesMapping(ctx context.Context, client sqlExecutor, schemaName string, attributesMapping *AttributesMapping) error {
+	assignments := make([]string, len(attributesMapping.Attributes))
+	args := make([]any, 0, len(attributesMapping.Attributes)+1)
+	args = append(args, attributesMapping.Name)
+
+	for i, key := range attributesMapping.Attributes {
+		assignments[i] = fmt.Sprintf("%s = $%d", QuoteIdentifier(attributeColumnName(i+1)), i+2)
+		args = append(args, key)
+	}
+
+	if len(assignments) == 0 {
+		return nil
+	}
+
+	query := fmt.Sprintf(attributesMappingUpdateSQL,
+		QuoteIdentifier(schemaName, AttributesMappingTableName), strings.Join(assignments, ", "))
 	_, err := client.ExecContext(ctx, query, args...)
 
 	return err
 }
 
-func extractArgs(attrsMapping *AttributesMapping) []any {
-	attrsMappingVal := reflect.Indirect(reflect.ValueOf(attrsMapping))
+// Assigns attribute columns to the keys of a metric in a transaction holding the lock on its mapping row,
+// so concurrent writers, also in other collectors, never hand out a column twice.
+// Returns the mapping as stored, including keys assigned by others in the meantime.
+//
+// Columns are added to the mapping table outside of the transaction: adding them while holding
+// a row lock could deadlock with a writer doing the same for another metric.
+func allocateAttributeColumns(ctx context.Context, client *sql.DB, schemaName, metricName string, keys []string, limit int) (AttributesMapping, error) {
+	for {
+		var attrsMapping AttributesMapping
+		missingColumns := 0
+
+		err := db.DoWithTx(ctx, client, func(tx *sql.Tx) error {
+			attrsMapping = AttributesMapping{Name: metricName}
+			if err := insertAttributesMapping(ctx, tx, schemaName, &attrsMapping); err != nil {
+				return err
+			}
 
-	args := make([]any, attrsMappingVal.NumField())
+			var columns int
+			var err error
+			attrsMapping, columns, err = lockAttributesMapping(ctx, tx, schemaName, metricName)
+			if err != nil {
+				return err
+			}
 
-	for i := range attrsMappingVal.NumField() {
-		field := attrsMappingVal.Field(i)
+			if !attrsMapping.assign(keys, limit) {
+				return nil
+			}
 
-		if field.IsValid() && !field.IsZero() {
-			args[i] = field.String()
-		} else {
-			args[i] = nil
+			// The mapping table has a name column besides the attribute columns
+			if len(attrsMapping.Attributes) > columns-1 {
+				missingColumns = len(attrsMapping.Attributes)
+				return nil
+			}
+
+			return updateAttributesMapping(ctx, tx, schemaName, &attrsMapping)
+		})
+		if err != nil {
+			return AttributesMapping{}, err
+		}
+
+		if missingColumns == 0 {
+			return attrsMapping, nil
+		}
+
+		err = addAttributeColumns(ctx, client, schemaName, AttributesMappingTableName, defaultAttributeColumnsNumber+1, missingColumns)
+		if err != nil {
+			return AttributesMapping{}, err
+		}
+	}
+}
+
+// Reads and locks the mapping row of a metric. Also returns the number of columns of the mapping table.
+func lockAttributesMapping(ctx context.Context, tx *sql.Tx, schemaName, metricName string) (AttributesMapping, int, error) {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(attributesMappingLockSQL, QuoteIdentifier(schemaName, AttributesMappingTableName)), metricName)
+	if err != nil {
+		return AttributesMapping{}, 0, err
+	}
+	defer rows.Close()
+
+	mappings, columns, err := scanAttributesMappings(rows)
+	if err != nil {
+		return AttributesMapping{}, 0, err
+	}
+
+	if len(mappings) != 1 {
+		return AttributesMapping{}, 0, fmt.Errorf("attributes mapping of %s not found", metricName)
+	}
+
+	return mappings[0], columns, nil
+}
+
+// Returns the number of attribute columns of the table, counting up to the first missing position
+func countAttributeColumns(ctx context.Context, client *sql.DB, schemaName, tableName string) (int, error) {
+	rows, err := client.QueryContext(ctx, listColumnsSQL, QuoteIdentifier(schemaName, tableName))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	positions := map[int]bool{}
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return 0, err
+		}
+		if pos, ok := parseAttributeColumnPosition(column); ok {
+			positions[pos] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for positions[count+1] {
+		count++
+	}
+
+	return count, nil
+}
+
+// Adds the attribute columns from position from to to, if missing, to the table
+func addAttributeColumns(ctx context.Context, client *sql.DB, schemaName, tableName string, from, to int) error {
+	for pos := from; pos <= to; pos++ {
+		query := fmt.Sprintf(addAttributeColumnSQL, QuoteIdentifier(schemaName, tableName), QuoteIdentifier(attributeColumnName(pos)))
+		if _, err := client.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("failed adding attribute column to %s: %w", tableName, err)
 		}
 	}
 
-	return args
+	return nil
 }
 
 func GetAttributesMappingByName(ctx context.Context, client *sql.DB, schemaName string, name string) (AttributesMapping, error) {
@@ -140,85 +339,74 @@ func GetAttributesMappingByName(ctx context.Context, client *sql.DB, schemaName
 }
 
 func GetAttributesMappingsByNames(ctx context.Context, client *sql.DB, schemaName string, names []string) ([]AttributesMapping, error) {
-	query := `SELECT * FROM "%s"."%s" WHERE name = ANY($1)`
-	rows, err := client.QueryContext(ctx, fmt.Sprintf(query, schemaName, AttributesMappingTableName), names)
+	query := `SELECT * FROM %s WHERE name = ANY($1)`
+	rows, err := client.QueryContext(ctx, fmt.Sprintf(query, QuoteIdentifier(schemaName, AttributesMappingTableName)), names)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+
+	result, _, err := scanAttributesMappings(rows)
+	return result, err
+}
 
+// Scans rows of the mapping table. Also returns the number of columns of the rows.
+func scanAttributesMappings(rows *sql.Rows) ([]AttributesMapping, int, error) {
 	result := []AttributesMapping{}
 
 	columns, err := rows.Columns()
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	for rows.Next() {
-		am := AttributesMapping{}
-
 		values := make([]any, len(columns))
 		for i := range values {
-			values[i] = new(sql.Null[any])
+			values[i] = new(sql.NullString)
 		}
 
 		err := rows.Scan(values...)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 
-		setValuesToAttrsMappingFields(&am, values)
-
-		result = append(result, am)
+		result = append(result, newAttributesMapping(columns, values))
 	}
 
-	return result, nil
+	return result, len(columns), rows.Err()
 }
 
-func setValuesToAttrsMappingFields(attrsMapping *AttributesMapping, values []any) error {
-	attrsMappingVal := reflect.Indirect(reflect.ValueOf(attrsMapping))
+// Builds a mapping from a row of the mapping table, whose attribute columns may be in any order
+func newAttributesMapping(columns []string, values []any) AttributesMapping {
+	am := AttributesMapping{}
 
-	for i := range attrsMappingVal.NumField() {
-		field := attrsMappingVal.Field(i)
-
-		if !field.CanSet() {
-			return fmt.Errorf("attribute field %s can't be set", field.String())
+	for i, column := range columns {
+		value := values[i].(*sql.NullString)
+		if column == "name" {
+			am.Name = value.String
+			continue
 		}
 
-		value, ok := values[i].(*sql.Null[any])
-		if !ok {
-			return fmt.Errorf("value can't be converted to sql.Null[any]")
+		pos, ok := parseAttributeColumnPosition(column)
+		if !ok || !value.Valid {
+			continue
 		}
 
-		if value != nil && value.Valid {
-			field.Set(reflect.ValueOf(value.V).Convert(field.Type()))
+		for len(am.Attributes) < pos {
+			am.Attributes = append(am.Attributes, "")
 		}
+		am.Attributes[pos-1] = value.String
 	}
 
-	return nil
+	return am
 }
 
+// GetAttributesValueAndFieldNameMap returns the attribute column name of every mapped key
 func GetAttributesValueAndFieldNameMap(attrsMapping *AttributesMapping) (map[string]string, error) {
 	result := map[string]string{}
 
-	attrsMappingVal := reflect.Indirect(reflect.ValueOf(attrsMapping))
-	attrsMappingTyp := attrsMappingVal.Type()
-	for n := range attrsMappingTyp.NumField() {
-		fieldTyp := attrsMappingTyp.Field(n)
-		fieldVal := attrsMappingVal.Field(n)
-
-		if fieldVal.IsValid() {
-			if !strings.HasPrefix(fieldTyp.Name, AttributesMappingAttributeFieldName) {
-				continue
-			}
-
-			if !fieldVal.IsZero() {
-				result[fieldVal.String()] = fieldTyp.Tag.Get("db")
-			} else {
-				break
-			}
-		} else {
-			return nil, fmt.Errorf("invalid attributes mapping field value")
-		}
+	for key, pos := range attrsMapping.positions() {
+		result[key] = attributeColumnName(pos)
 	}
 
 	return result, nil
@@ -233,50 +421,3 @@ func groupAttrsMappingsByName(attrsMappings []AttributesMapping) map[string]Attr
 
 	return result
 }
-
-func getAttrsNameAndPosMap(attrsMapping *AttributesMapping) (map[string]int, error) {
-	result := map[string]int{}
-
-	attrsMappingVal := reflect.Indirect(reflect.ValueOf(attrsMapping))
-	for pos := 1; pos <= maxAttributesNumber; pos++ {
-		field := attrsMappingVal.FieldByName(AttributesMappingAttributeFieldName + strconv.Itoa(pos))
-
-		if field.IsValid() {
-			if !field.IsZero() {
-				result[field.String()] = pos
-			} else {
-				break
-			}
-		} else {
-			return nil, fmt.Errorf("invalid attributes mapping field value")
-		}
-	}
-
-	return result, nil
-}
-
-func findNextAvailableAttrPos(attrsMapping *AttributesMapping) (int, error) {
-	attrsMappingVal := reflect.ValueOf(attrsMapping).Elem()
-	for pos := 1; pos <= maxAttributesNumber; pos++ {
-		field := attrsMappingVal.FieldByName(AttributesMappingAttributeFieldName + strconv.Itoa(pos))
-
-		if field.IsZero() {
-			return pos, nil
-		}
-	}
-
-	return 0, fmt.Errorf("there are no more available attribute positions")
-}
-
-func setAttrValueByPos(attrsMapping *AttributesMapping, pos int, name string) error {
-	attrsMappingVal := reflect.Indirect(reflect.ValueOf(attrsMapping))
-
-	field := attrsMappingVal.FieldByName(AttributesMappingAttributeFieldName + strconv.Itoa(pos))
-	if !field.CanSet() {
-		return fmt.Errorf("attribute field can't be set")
-	}
-
-	field.Set(reflect.ValueOf(name))
-
-	return nil
-}
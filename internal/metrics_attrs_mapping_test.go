@@ -0,0 +1,168 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+)
+
+func TestAttributesMappingAssignAndSplit(t *testing.T) {
+	am := AttributesMapping{Name: "k8s.pod.cpu.usage", Attributes: []string{"k8s.pod.name"}}
+
+	attrs := pcommon.NewMap()
+	attrs.PutStr("k8s.pod.name", "api-0")
+	attrs.PutStr("k8s.namespace.name", "prod")
+	attrs.PutInt("k8s.container.restarts", 3)
+
+	keys := am.unmappedKeys([]pcommon.Map{attrs, attrs})
+	assert.ElementsMatch(t, []string{"k8s.namespace.name", "k8s.container.restarts"}, keys)
+
+	assert.True(t, am.assign([]string{"k8s.namespace.name", "k8s.container.restarts"}, 2))
+	assert.Equal(t, []string{"k8s.pod.name", "k8s.namespace.name"}, am.Attributes)
+	assert.False(t, am.assign([]string{"k8s.container.restarts"}, 2))
+
+	values, extra, err := am.split(attrs)
+	require.NoError(t, err)
+	assert.Equal(t, []any{"api-0", "prod"}, values)
+
+	var extraAttrs map[string]any
+	require.NoError(t, json.Unmarshal(extra, &extraAttrs))
+	assert.Equal(t, map[string]any{"k8s.container.restarts": float64(3)}, extraAttrs)
+
+	attrs.Remove("k8s.container.restarts")
+	_, extra, err = am.split(attrs)
+	require.NoError(t, err)
+	assert.Nil(t, extra)
+}
+
+func TestAttributesMappingBeyondDefaultColumns(t *testing.T) {
+	am := AttributesMapping{Name: "m"}
+
+	attrs := pcommon.NewMap()
+	for _, k := range attributeColumnNames(25) {
+		attrs.PutStr("key."+k, k)
+	}
+
+	assert.True(t, am.assign(am.unmappedKeys([]pcommon.Map{attrs}), 30))
+	assert.Len(t, am.Attributes, 25)
+
+	columns := metricTableInsertColumns(mappedMetricAttributes{mapping: am}, []string{"value"})
+	assert.Contains(t, columns, "attribute25")
+	assert.Equal(t, []string{"extra_attributes", "metadata", "value"}, columns[len(columns)-3:])
+}
+
+func TestNewAttributesMapping(t *testing.T) {
+	columns := []string{"name", "attribute1", "attribute2", "attribute21", "attribute3"}
+	values := []any{
+		&sql.NullString{String: "m", Valid: true},
+		&sql.NullString{String: "a", Valid: true},
+		&sql.NullString{String: "b", Valid: true},
+		&sql.NullString{},
+		&sql.NullString{String: "c", Valid: true},
+	}
+
+	am := newAttributesMapping(columns, values)
+	assert.Equal(t, "m", am.Name)
+	assert.Equal(t, []string{"a", "b", "c"}, am.Attributes)
+
+	fields, err := GetAttributesValueAndFieldNameMap(&am)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "attribute1", "b": "attribute2", "c": "attribute3"}, fields)
+}
+
+func TestAllocateAttributeColumnsParallelWriters(t *testing.T) {
+	client, schemaName := openTestSchema(t)
+	ctx := context.Background()
+
+	// Every writer shares one key and brings its own, more than the mapping table has columns for
+	const writers, keysPerWriter = 8, 4
+	results := make([]AttributesMapping, writers)
+	errs := make([]error, writers)
+
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			keys := []string{"shared"}
+			for k := range keysPerWriter {
+				keys = append(keys, fmt.Sprintf("writer%d.key%d", w, k))
+			}
+			results[w], errs[w] = allocateAttributeColumns(ctx, client, schemaName, "parallel.metric", keys, 100)
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+
+	stored, err := GetAttributesMappingByName(ctx, client, schemaName, "parallel.metric")
+	require.NoError(t, err)
+	require.Len(t, stored.Attributes, 1+writers*keysPerWriter)
+
+	positions := stored.positions()
+	assert.Len(t, positions, len(stored.Attributes), "every key must have its own column")
+	for _, result := range results {
+		for i, key := range result.Attributes {
+			assert.Equal(t, positions[key], i+1, "column of %s", key)
+		}
+	}
+}
+
+func TestMapMetricAttributesAddsColumnsAfterFailure(t *testing.T) {
+	client, schemaName := openTestSchema(t)
+	ctx := context.Background()
+
+	settings := MetricsSettings{SchemaName: schemaName, AttributeColumns: 30, Cache: NewMetricsCache()}
+	group := &gaugeMetricsGroup{MetricsType: pmetric.MetricTypeGauge, MetricsSettings: settings}
+	tableName := "wide.metric"
+
+	attrs := pcommon.NewMap()
+	for i := 1; i <= defaultAttributeColumnsNumber+5; i++ {
+		attrs.PutStr(fmt.Sprintf("key%d", i), "value")
+	}
+
+	table, _, err := ensureMetricTable(ctx, client, group, settings, pmetric.MetricTypeGauge, tableName)
+	require.NoError(t, err)
+
+	// Adding the columns fails while another transaction holds a lock on the metric table,
+	// after the grown mapping was stored
+	blocker, err := client.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	_, err = blocker.ExecContext(ctx, "LOCK TABLE "+QuoteIdentifier(schemaName, tableName)+" IN ACCESS SHARE MODE")
+	require.NoError(t, err)
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, time.Second)
+	_, err = mapMetricAttributes(timeoutCtx, client, settings, map[string]AttributesMapping{}, "wide.metric", tableName, table, []pcommon.Map{attrs})
+	cancel()
+	require.Error(t, err)
+	require.NoError(t, blocker.Rollback())
+
+	// The next batch, e.g. after the failed write invalidated the cache, loads the stored mapping that's ahead of the table
+	settings.Cache = NewMetricsCache()
+	group.MetricsSettings = settings
+
+	table, _, err = ensureMetricTable(ctx, client, group, settings, pmetric.MetricTypeGauge, tableName)
+	require.NoError(t, err)
+	mappings, err := loadAttributesMappings(ctx, client, settings, []string{"wide.metric"})
+	require.NoError(t, err)
+	require.Len(t, mappings["wide.metric"].Attributes, defaultAttributeColumnsNumber+5)
+
+	_, err = mapMetricAttributes(ctx, client, settings, mappings, "wide.metric", tableName, table, []pcommon.Map{attrs})
+	require.NoError(t, err)
+
+	columns, err := countAttributeColumns(ctx, client, schemaName, tableName)
+	require.NoError(t, err)
+	assert.Equal(t, defaultAttributeColumnsNumber+5, columns)
+}
@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+)
+
+// AttributesStorage defines how data point attributes are stored in metric tables
+type AttributesStorage string
+
+const (
+	// One attributeN column per attribute key, mapped in the attributes mapping table
+	AttributesStorageColumns AttributesStorage = "columns"
+	// A single "attributes" JSONB column
+	AttributesStorageJSONB AttributesStorage = "jsonb"
+)
+
+// Encodes data point attributes into the attribute columns of a metric table
+type metricAttributes interface {
+	// Insert columns holding the attributes
+	columns() []string
+	// Values of the columns for the attributes of a data point
+	values(attrs pcommon.Map) ([]any, error)
+}
+
+type mappedMetricAttributes struct {
+	mapping AttributesMapping
+}
+
+func (a mappedMetricAttributes) columns() []string {
+	return append(attributeColumnNames(len(a.mapping.Attributes)), "extra_attributes")
+}
+
+func (a mappedMetricAttributes) values(attrs pcommon.Map) ([]any, error) {
+	values, extra, err := a.mapping.split(attrs)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(values, extra), nil
+}
+
+type jsonbMetricAttributes struct{}
+
+func (jsonbMetricAttributes) columns() []string {
+	return []string{"attributes"}
+}
+
+func (jsonbMetricAttributes) values(attrs pcommon.Map) ([]any, error) {
+	value, err := MarshalAttributes(attrs)
+	if err != nil {
+		return nil, err
+	}
+
+	return []any{value}, nil
+}
+
+// Loads the attributes mappings of the metrics, querying only the ones missing from the cache.
+// No mappings are used with JSONB storage.
+func loadAttributesMappings(ctx context.Context, client *sql.DB, settings MetricsSettings, names []string) (map[string]AttributesMapping, error) {
+	result := map[string]AttributesMapping{}
+	if settings.AttributesStorage == AttributesStorageJSONB {
+		return result, nil
+	}
+
+	var missing []string
+	for _, name := range names {
+		if am, present := settings.Cache.mapping(name); present {
+			result[name] = am
+		} else {
+			missing = append(missing, name)
+		}
+	}
+
+	if len(missing) == 0 {
+		return result, nil
+	}
+
+	attributesMappings, err := GetAttributesMappingsByNames(ctx, client, settings.SchemaName, missing)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, am := range attributesMappings {
+		settings.Cache.setMapping(am)
+		result[am.Name] = am
+	}
+
+	return result, nil
+}
+
+// Returns the encoder of the data point attributes of a metric, mapping new attribute keys to columns if needed
+func prepareMetricAttributes(ctx context.Context, client *sql.DB, settings MetricsSettings, mappings map[string]AttributesMapping, metricName, tableName string, table metricTable, attrs []pcommon.Map) (metricAttributes, error) {
+	if settings.AttributesStorage == AttributesStorageJSONB {
+		return jsonbMetricAttributes{}, nil
+	}
+
+	mapping, err := mapMetricAttributes(ctx, client, settings, mappings, metricName, tableName, table, attrs)
+	if err != nil {
+		return nil, err
+	}
+
+	return mappedMetricAttributes{mapping: mapping}, nil
+}
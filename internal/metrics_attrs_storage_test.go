@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+)
+
+func TestJSONBMetricAttributes(t *testing.T) {
+	settings := MetricsSettings{AttributesStorage: AttributesStorageJSONB}
+
+	attributes, err := prepareMetricAttributes(context.Background(), nil, settings, nil, "m", "m", metricTable{}, nil)
+	require.NoError(t, err)
+
+	attrs := pcommon.NewMap()
+	attrs.PutStr("k8s.pod.name", "api-0")
+	attrs.PutInt("attempt", 2)
+
+	values, err := attributes.values(attrs)
+	require.NoError(t, err)
+	require.Len(t, values, 1)
+
+	var got map[string]any
+	require.NoError(t, json.Unmarshal(values[0].([]byte), &got))
+	assert.Equal(t, map[string]any{"k8s.pod.name": "api-0", "attempt": float64(2)}, got)
+
+	columns := metricTableInsertColumns(attributes, []string{"value"})
+	assert.Equal(t, []string{"attributes", "metadata", "value"}, columns[len(columns)-3:])
+	assert.NotContains(t, columns, "attribute1")
+}
+
+func TestBaseMetricTableColumnsByAttributesStorage(t *testing.T) {
+	columns := getBaseMetricTableColumns(MetricsSettings{AttributesStorage: AttributesStorageJSONB})
+	assert.Contains(t, columns, "attributes JSONB")
+	assert.NotContains(t, columns, "attribute1 VARCHAR")
+	assert.NotContains(t, columns, "extra_attributes JSONB")
+
+	columns = getBaseMetricTableColumns(MetricsSettings{AttributesStorage: AttributesStorageColumns})
+	assert.Contains(t, columns, "attribute20 VARCHAR")
+	assert.Contains(t, columns, "extra_attributes JSONB")
+	assert.NotContains(t, columns, "attributes JSONB")
+}
+
+func TestPrepareMetricTablesSwitchesBackToColumns(t *testing.T) {
+	client, schemaName := openTestSchema(t)
+	ctx := context.Background()
+
+	settings := MetricsSettings{SchemaName: schemaName, AttributesStorage: AttributesStorageJSONB, Cache: NewMetricsCache()}
+	group := &gaugeMetricsGroup{MetricsType: pmetric.MetricTypeGauge, MetricsSettings: settings}
+	_, created, err := ensureMetricTable(ctx, client, group, settings, pmetric.MetricTypeGauge, "jsonb.metric")
+	require.NoError(t, err)
+	require.True(t, created)
+
+	settings.AttributesStorage = AttributesStorageColumns
+	require.NoError(t, PrepareMetricTables(ctx, client, settings))
+	require.NoError(t, PrepareMetricTables(ctx, client, settings))
+
+	var count int
+	query := `SELECT count(*) FROM pg_attribute WHERE attrelid = to_regclass($1) AND (attname ~ '^attribute[0-9]+$' OR attname = 'extra_attributes') AND NOT attisdropped`
+	require.NoError(t, client.QueryRowContext(ctx, query, QuoteIdentifier(schemaName, "jsonb.metric")).Scan(&count))
+	assert.Equal(t, defaultAttributeColumnsNumber+1, count)
+}
@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"slices"
+	"sync"
+)
+
+// MetricsCache remembers the metric tables known to exist and the attributes mappings across batches,
+// so steady-state inserts need no catalog queries. It's safe for concurrent use and a nil cache caches nothing.
+type MetricsCache struct {
+	mu       sync.RWMutex
+	tables   map[string]metricTable
+	mappings map[string]AttributesMapping
+}
+
+func NewMetricsCache() *MetricsCache {
+	return &MetricsCache{
+		tables:   map[string]metricTable{},
+		mappings: map[string]AttributesMapping{},
+	}
+}
+
+func (c *MetricsCache) table(tableName string) (metricTable, bool) {
+	if c == nil {
+		return metricTable{}, false
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	table, present := c.tables[tableName]
+	return table, present
+}
+
+func (c *MetricsCache) addTable(tableName string, table metricTable) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.tables[tableName] = table
+}
+
+// Returns a copy of the cached mapping, which the caller may modify
+func (c *MetricsCache) mapping(metricName string) (AttributesMapping, bool) {
+	if c == nil {
+		return AttributesMapping{}, false
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	am, present := c.mappings[metricName]
+	am.Attributes = slices.Clone(am.Attributes)
+	return am, present
+}
+
+func (c *MetricsCache) setMapping(am AttributesMapping) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	am.Attributes = slices.Clone(am.Attributes)
+	c.mappings[am.Name] = am
+}
+
+// Invalidate forgets the table and the mapping of a metric, e.g. after a failed statement
+// because the table was changed or dropped outside of the exporter
+func (c *MetricsCache) Invalidate(tableName, metricName string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.tables, tableName)
+	delete(c.mappings, metricName)
+}
@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsCache(t *testing.T) {
+	c := NewMetricsCache()
+
+	c.addTable("cpu", metricTable{nativeArrays: true})
+	c.setMapping(AttributesMapping{Name: "cpu", Attributes: []string{"host"}})
+	table, present := c.table("cpu")
+	assert.True(t, present)
+	assert.True(t, table.nativeArrays)
+
+	am, present := c.mapping("cpu")
+	assert.True(t, present)
+	am.Attributes = append(am.Attributes[:0], "changed")
+
+	am, _ = c.mapping("cpu")
+	assert.Equal(t, []string{"host"}, am.Attributes, "cached mapping must not alias the returned copy")
+
+	c.Invalidate("cpu", "cpu")
+	_, present = c.table("cpu")
+	assert.False(t, present)
+	_, present = c.mapping("cpu")
+	assert.False(t, present)
+}
+
+func TestNilMetricsCache(t *testing.T) {
+	var c *MetricsCache
+
+	c.addTable("cpu", metricTable{})
+	c.setMapping(AttributesMapping{Name: "cpu"})
+	c.Invalidate("cpu", "cpu")
+
+	_, present := c.table("cpu")
+	assert.False(t, present)
+	_, present = c.mapping("cpu")
+	assert.False(t, present)
+}
+
+func TestMetricsCacheConcurrentUse(t *testing.T) {
+	c := NewMetricsCache()
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 100 {
+				name := strconv.Itoa(j % 10)
+				c.addTable(name, metricTable{})
+				c.setMapping(AttributesMapping{Name: name, Attributes: []string{strconv.Itoa(i)}})
+				c.table(name)
+				c.mapping(name)
+				if j%7 == 0 {
+					c.Invalidate(name, name)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/destrex271/postgresexporter/internal/traceutil"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+)
+
+const (
+	// Exemplars of all metrics, written besides the "exemplars" column of the metric tables if enabled
+	ExemplarsTableName = "otel_metrics_exemplars"
+
+	// Jumping from an exemplar to its trace, and from a trace to the metrics it shows up in
+	createExemplarsTraceIDIndexSQL = `CREATE INDEX IF NOT EXISTS %s ON %s (trace_id)`
+	createExemplarsNameIndexSQL    = `CREATE INDEX IF NOT EXISTS %s ON %s (metric_name, timestamp)`
+)
+
+var (
+	exemplarsTableInsertColumns = []string{
+		"metric_name", "metric_type", "service_name", "attributes",
+		"timestamp", "value", "trace_id", "span_id", "filtered_attributes",
+	}
+
+	exemplarsTableColumns = []string{
+		"metric_name  VARCHAR NOT NULL",
+		"metric_type  INTEGER",
+		"service_name VARCHAR",
+		"attributes   JSONB",
+
+		"timestamp           TIMESTAMPTZ NOT NULL",
+		"value               DOUBLE PRECISION",
+		"trace_id            VARCHAR",
+		"span_id             VARCHAR",
+		"filtered_attributes JSONB",
+	}
+)
+
+// Exemplar as stored in the "exemplars" JSONB column of metric tables
+type metricExemplar struct {
+	Timestamp          time.Time       `json:"timestamp"`
+	Value              any             `json:"value"`
+	TraceID            string          `json:"trace_id"`
+	SpanID             string          `json:"span_id"`
+	FilteredAttributes json.RawMessage `json:"filtered_attributes"`
+}
+
+// Encodes exemplars as a JSON array. Int values stay ints, non-finite doubles are encoded as strings.
+func marshalExemplars(exemplars pmetric.ExemplarSlice) ([]byte, error) {
+	result := make([]metricExemplar, 0, exemplars.Len())
+	for i := range exemplars.Len() {
+		e := exemplars.At(i)
+
+		filteredAttrs, err := MarshalAttributes(e.FilteredAttributes())
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, metricExemplar{
+			Timestamp:          e.Timestamp().AsTime(),
+			Value:              exemplarValue(e),
+			TraceID:            traceutil.TraceIDToHexOrEmptyString(e.TraceID()),
+			SpanID:             traceutil.SpanIDToHexOrEmptyString(e.SpanID()),
+			FilteredAttributes: filteredAttrs,
+		})
+	}
+
+	return json.Marshal(result)
+}
+
+func exemplarValue(e pmetric.Exemplar) any {
+	switch e.ValueType() {
+	case pmetric.ExemplarValueTypeInt:
+		return e.IntValue()
+	case pmetric.ExemplarValueTypeDouble:
+		return sanitizeJSONValue(e.DoubleValue())
+	default:
+		return nil
+	}
+}
+
+// Appends a row of the exemplars table for every exemplar of a data point. On error rows are returned unchanged.
+func appendExemplarRows(rows [][]any, metricName string, metricsType pmetric.MetricType, serviceName string, attrs pcommon.Map, exemplars pmetric.ExemplarSlice) ([][]any, error) {
+	if exemplars.Len() == 0 {
+		return rows, nil
+	}
+
+	attributes, err := MarshalAttributes(attrs)
+	if err != nil {
+		return rows, err
+	}
+
+	for i := range exemplars.Len() {
+		e := exemplars.At(i)
+
+		filteredAttrs, err := MarshalAttributes(e.FilteredAttributes())
+		if err != nil {
+			return rows, err
+		}
+
+		var value float64
+		switch e.ValueType() {
+		case pmetric.ExemplarValueTypeInt:
+			value = float64(e.IntValue())
+		case pmetric.ExemplarValueTypeDouble:
+			value = e.DoubleValue()
+		}
+
+		rows = append(rows, []any{
+			metricName, int32(metricsType), serviceName, attributes,
+			e.Timestamp().AsTime(), value,
+			traceutil.TraceIDToHexOrEmptyString(e.TraceID()),
+			traceutil.SpanIDToHexOrEmptyString(e.SpanID()),
+			filteredAttrs,
+		})
+	}
+
+	return rows, nil
+}
+
+// Returns the rows to write into the exemplars table
+func exemplarTableRows(rows [][]any) tableRows {
+	return tableRows{table: ExemplarsTableName, columns: exemplarsTableInsertColumns, rows: rows}
+}
+
+// Creates the exemplars table and its indexes if they don't exist
+func createExemplarsTable(ctx context.Context, client *sql.DB, settings MetricsSettings) error {
+	table := QuoteIdentifier(settings.SchemaName, ExemplarsTableName)
+	queries := []string{
+		fmt.Sprintf(createTableIfNotExistsSQL, table, strings.Join(exemplarsTableColumns, ",")),
+		fmt.Sprintf(createExemplarsTraceIDIndexSQL, QuoteIdentifier(ExemplarsTableName+"_trace_id_idx"), table),
+		fmt.Sprintf(createExemplarsNameIndexSQL, QuoteIdentifier(ExemplarsTableName+"_name_timestamp_idx"), table),
+	}
+
+	for _, query := range queries {
+		if _, err := client.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("failed creating exemplars table: %w", err)
+		}
+	}
+
+	return nil
+}
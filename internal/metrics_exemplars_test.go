@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+)
+
+func newTestExemplars() pmetric.ExemplarSlice {
+	ts := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	exemplars := pmetric.NewExemplarSlice()
+	e := exemplars.AppendEmpty()
+	e.SetTimestamp(pcommon.NewTimestampFromTime(ts))
+	e.SetDoubleValue(0.25)
+	e.SetTraceID(pcommon.TraceID{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10})
+	e.SetSpanID(pcommon.SpanID{0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18})
+	e.FilteredAttributes().PutStr("http.route", "/users")
+
+	e = exemplars.AppendEmpty()
+	e.SetTimestamp(pcommon.NewTimestampFromTime(ts))
+	e.SetIntValue(7)
+
+	e = exemplars.AppendEmpty()
+	e.SetTimestamp(pcommon.NewTimestampFromTime(ts))
+	e.SetDoubleValue(math.Inf(1))
+
+	return exemplars
+}
+
+func TestMarshalExemplars(t *testing.T) {
+	data, err := marshalExemplars(newTestExemplars())
+	require.NoError(t, err)
+
+	assert.JSONEq(t, `[
+		{
+			"timestamp": "2024-05-01T12:00:00Z",
+			"value": 0.25,
+			"trace_id": "0102030405060708090a0b0c0d0e0f10",
+			"span_id": "1112131415161718",
+			"filtered_attributes": {"http.route": "/users"}
+		},
+		{"timestamp": "2024-05-01T12:00:00Z", "value": 7, "trace_id": "", "span_id": "", "filtered_attributes": {}},
+		{"timestamp": "2024-05-01T12:00:00Z", "value": "+Inf", "trace_id": "", "span_id": "", "filtered_attributes": {}}
+	]`, string(data))
+
+	data, err = marshalExemplars(pmetric.NewExemplarSlice())
+	require.NoError(t, err)
+	assert.Equal(t, "[]", string(data))
+}
+
+func TestAppendExemplarRows(t *testing.T) {
+	attrs := pcommon.NewMap()
+	attrs.PutStr("host", "a")
+
+	rows, err := appendExemplarRows(nil, "http.server.duration", pmetric.MetricTypeHistogram, "api", attrs, newTestExemplars())
+	require.NoError(t, err)
+	require.Len(t, rows, 3)
+
+	for _, row := range rows {
+		assert.Len(t, row, len(exemplarsTableInsertColumns))
+	}
+
+	assert.Equal(t, []any{
+		"http.server.duration", int32(pmetric.MetricTypeHistogram), "api", []byte(`{"host":"a"}`),
+		time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), 0.25,
+		"0102030405060708090a0b0c0d0e0f10", "1112131415161718", []byte(`{"http.route":"/users"}`),
+	}, rows[0])
+	assert.Equal(t, 7.0, rows[1][5])
+
+	rows, err = appendExemplarRows(rows, "http.server.duration", pmetric.MetricTypeHistogram, "api", attrs, pmetric.NewExemplarSlice())
+	require.NoError(t, err)
+	assert.Len(t, rows, 3)
+}
+
+func TestExemplarsRetention(t *testing.T) {
+	settings := MetricsSettings{Retention: 24 * time.Hour}
+	assert.Equal(t, 24*time.Hour, settings.exemplarsRetention())
+
+	settings.RetentionByType.Histogram = 72 * time.Hour
+	assert.Equal(t, 72*time.Hour, settings.exemplarsRetention())
+
+	settings.Retention = 0
+	assert.Zero(t, settings.exemplarsRetention(), "gauges are kept forever, so are their exemplars")
+}
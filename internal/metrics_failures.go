@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+
+	"go.opentelemetry.io/collector/consumer/consumererror"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.uber.org/zap"
+)
+
+// metricsFailures collects what went wrong while inserting a batch of metrics.
+// Metrics failing with a retryable error are copied, so only they are sent again.
+type metricsFailures struct {
+	permanent error
+	retryable error
+
+	failed pmetric.Metrics
+	scopes map[*ResourceMetadata]pmetric.MetricSlice
+}
+
+func newMetricsFailures() *metricsFailures {
+	return &metricsFailures{
+		failed: pmetric.NewMetrics(),
+		scopes: map[*ResourceMetadata]pmetric.MetricSlice{},
+	}
+}
+
+// Records that no data point of a metric was written. copyTo copies the metric for retrying.
+func (f *metricsFailures) fail(resMetadata *ResourceMetadata, copyTo func(pmetric.Metric), err error) {
+	err = ClassifyError(err)
+	if consumererror.IsPermanent(err) {
+		f.permanent = errors.Join(f.permanent, err)
+		return
+	}
+
+	f.retryable = errors.Join(f.retryable, err)
+	copyTo(f.scopeMetrics(resMetadata).AppendEmpty())
+}
+
+// Records a data point that's dropped because it can never be written
+func (f *metricsFailures) reject(err error) {
+	f.permanent = errors.Join(f.permanent, consumererror.NewPermanent(err))
+}
+
+// Returns the metrics of the resource and scope in the failed metrics, adding them if needed
+func (f *metricsFailures) scopeMetrics(resMetadata *ResourceMetadata) pmetric.MetricSlice {
+	if metrics, present := f.scopes[resMetadata]; present {
+		return metrics
+	}
+
+	rm := f.failed.ResourceMetrics().AppendEmpty()
+	rm.SetSchemaUrl(resMetadata.ResURL)
+	resMetadata.ResAttrs.CopyTo(rm.Resource().Attributes())
+
+	sm := rm.ScopeMetrics().AppendEmpty()
+	sm.SetSchemaUrl(resMetadata.ScopeUrl)
+	resMetadata.InstrScope.CopyTo(sm.Scope())
+
+	f.scopes[resMetadata] = sm.Metrics()
+	return sm.Metrics()
+}
+
+// Returns nil if everything was written. Otherwise a retryable error carrying the metrics to send again,
+// or a permanent error if retrying can't help. Permanent failures next to retryable ones are only logged,
+// a permanent error would prevent the retry.
+func (f *metricsFailures) err() error {
+	if f.retryable == nil {
+		if f.permanent == nil {
+			return nil
+		}
+		return fmt.Errorf("insert metrics failed: %w", f.permanent)
+	}
+
+	if f.permanent != nil {
+		logger.Error("Dropping metrics that can't be written", zap.Error(f.permanent))
+	}
+
+	return consumererror.NewMetrics(fmt.Errorf("insert metrics failed: %w", f.retryable), f.failed)
+}
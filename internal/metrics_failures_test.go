@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/consumer/consumererror"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.uber.org/zap"
+)
+
+func newTestGaugeMetric(resMetadata *ResourceMetadata, name string) *gaugeMetric {
+	gauge := pmetric.NewGauge()
+	dp := gauge.DataPoints().AppendEmpty()
+	dp.SetDoubleValue(1.5)
+	dp.Attributes().PutStr("host", "a")
+
+	return &gaugeMetric{resMetadata: resMetadata, gauge: gauge, name: name, unit: "1", metadata: pcommon.NewMap()}
+}
+
+func TestMetricsFailures(t *testing.T) {
+	SetLogger(zap.NewNop())
+
+	resAttrs := pcommon.NewMap()
+	resAttrs.PutStr("service.name", "api")
+	scope := pcommon.NewInstrumentationScope()
+	scope.SetName("meter")
+	resMetadata := &ResourceMetadata{ResURL: "res-url", ResAttrs: resAttrs, InstrScope: scope, ScopeUrl: "scope-url"}
+
+	t.Run("nothing failed", func(t *testing.T) {
+		assert.NoError(t, newMetricsFailures().err())
+	})
+
+	t.Run("only permanent failures", func(t *testing.T) {
+		failures := newMetricsFailures()
+		m := newTestGaugeMetric(resMetadata, "cpu")
+		failures.fail(resMetadata, m.copyTo, &pgconn.PgError{Code: "22003"})
+		failures.reject(errors.New("zero timestamp"))
+
+		err := failures.err()
+		require.Error(t, err)
+		assert.True(t, consumererror.IsPermanent(err))
+	})
+
+	t.Run("retryable failures carry the failed metrics", func(t *testing.T) {
+		failures := newMetricsFailures()
+		cpu := newTestGaugeMetric(resMetadata, "cpu")
+		memory := newTestGaugeMetric(resMetadata, "memory")
+		disk := newTestGaugeMetric(resMetadata, "disk")
+		failures.fail(resMetadata, cpu.copyTo, &pgconn.PgError{Code: "40P01"})
+		failures.fail(resMetadata, memory.copyTo, fmt.Errorf("insert: %w", io.ErrUnexpectedEOF))
+		failures.fail(resMetadata, disk.copyTo, &pgconn.PgError{Code: "22003"})
+
+		err := failures.err()
+		require.Error(t, err)
+		assert.False(t, consumererror.IsPermanent(err))
+
+		var metricsErr consumererror.Metrics
+		require.ErrorAs(t, err, &metricsErr)
+		failed := metricsErr.Data()
+
+		require.Equal(t, 1, failed.ResourceMetrics().Len())
+		rm := failed.ResourceMetrics().At(0)
+		assert.Equal(t, "res-url", rm.SchemaUrl())
+		assert.Equal(t, resAttrs.AsRaw(), rm.Resource().Attributes().AsRaw())
+
+		require.Equal(t, 1, rm.ScopeMetrics().Len())
+		sm := rm.ScopeMetrics().At(0)
+		assert.Equal(t, "scope-url", sm.SchemaUrl())
+		assert.Equal(t, "meter", sm.Scope().Name())
+
+		require.Equal(t, 2, sm.Metrics().Len())
+		assert.Equal(t, "cpu", sm.Metrics().At(0).Name())
+		assert.Equal(t, "memory", sm.Metrics().At(1).Name())
+		assert.Equal(t, pmetric.MetricTypeGauge, sm.Metrics().At(0).Type())
+		assert.Equal(t, 1.5, sm.Metrics().At(0).Gauge().DataPoints().At(0).DoubleValue())
+	})
+}
@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"fmt"
+)
+
+const (
+	// Estimates the q-quantile of an explicit bucket histogram like Prometheus' histogram_quantile:
+	// linear interpolation within the bucket holding the quantile, the lower bound of the first bucket is 0
+	// unless its upper bound is negative, and the overflow bucket yields the highest bound.
+	createHistogramQuantileFunctionSQL = `
+	CREATE OR REPLACE FUNCTION %[1]s.otel_histogram_quantile(bounds DOUBLE PRECISION[], counts BIGINT[], q DOUBLE PRECISION)
+	RETURNS DOUBLE PRECISION
+	LANGUAGE plpgsql IMMUTABLE
+	AS $$
+	DECLARE
+		n           INTEGER := coalesce(array_length(counts, 1), 0);
+		total       DOUBLE PRECISION := 0;
+		target      DOUBLE PRECISION;
+		seen        DOUBLE PRECISION := 0;
+		lower_bound DOUBLE PRECISION;
+	BEGIN
+		IF q IS NULL OR q < 0 OR q > 1 THEN
+			RETURN NULL;
+		END IF;
+
+		FOR i IN 1..n LOOP
+			total := total + coalesce(counts[i], 0);
+		END LOOP;
+		IF total = 0 THEN
+			RETURN NULL;
+		END IF;
+
+		target := q * total;
+		FOR i IN 1..n LOOP
+			IF counts[i] > 0 AND seen + counts[i] >= target THEN
+				IF i > coalesce(array_length(bounds, 1), 0) THEN
+					RETURN bounds[i - 1];
+				END IF;
+
+				IF i = 1 THEN
+					lower_bound := least(0, bounds[1]);
+				ELSE
+					lower_bound := bounds[i - 1];
+				END IF;
+
+				RETURN lower_bound + (bounds[i] - lower_bound) * (target - seen) / counts[i];
+			END IF;
+			seen := seen + coalesce(counts[i], 0);
+		END LOOP;
+
+		RETURN NULL;
+	END
+	$$
+	`
+
+	// Same for histograms stored as JSONB arrays
+	createHistogramQuantileJSONBFunctionSQL = `
+	CREATE OR REPLACE FUNCTION %[1]s.otel_histogram_quantile(bounds JSONB, counts JSONB, q DOUBLE PRECISION)
+	RETURNS DOUBLE PRECISION
+	LANGUAGE sql IMMUTABLE
+	AS $$
+		SELECT %[1]s.otel_histogram_quantile(
+			ARRAY(SELECT e::DOUBLE PRECISION FROM jsonb_array_elements_text(bounds) WITH ORDINALITY AS t(e, n) ORDER BY n),
+			ARRAY(SELECT e::BIGINT FROM jsonb_array_elements_text(counts) WITH ORDINALITY AS t(e, n) ORDER BY n),
+			q
+		)
+	$$
+	`
+
+	// Estimates the q-quantile of an exponential histogram. Bucket index i holds the values in
+	// (base^i, base^(i+1)] with base = 2^(2^-scale), negative buckets mirror them. Values are interpolated
+	// linearly within the bucket holding the quantile, the zero bucket yields 0.
+	createExpHistogramQuantileFunctionSQL = `
+	CREATE OR REPLACE FUNCTION %[1]s.otel_exp_histogram_quantile(
+		scale INTEGER, zero_count BIGINT,
+		positive_offset INTEGER, positive_bucket_counts BIGINT[],
+		negative_offset INTEGER, negative_bucket_counts BIGINT[],
+		q DOUBLE PRECISION
+	)
+	RETURNS DOUBLE PRECISION
+	LANGUAGE plpgsql IMMUTABLE
+	AS $$
+	DECLARE
+		base        DOUBLE PRECISION := power(2::DOUBLE PRECISION, power(2::DOUBLE PRECISION, -scale));
+		positive_n  INTEGER := coalesce(array_length(positive_bucket_counts, 1), 0);
+		negative_n  INTEGER := coalesce(array_length(negative_bucket_counts, 1), 0);
+		zeros       DOUBLE PRECISION := coalesce(zero_count, 0);
+		total       DOUBLE PRECISION := coalesce(zero_count, 0);
+		target      DOUBLE PRECISION;
+		seen        DOUBLE PRECISION := 0;
+		idx         INTEGER;
+		lower_bound DOUBLE PRECISION;
+		upper_bound DOUBLE PRECISION;
+	BEGIN
+		IF q IS NULL OR q < 0 OR q > 1 THEN
+			RETURN NULL;
+		END IF;
+
+		FOR i IN 1..positive_n LOOP
+			total := total + coalesce(positive_bucket_counts[i], 0);
+		END LOOP;
+		FOR i IN 1..negative_n LOOP
+			total := total + coalesce(negative_bucket_counts[i], 0);
+		END LOOP;
+		IF total = 0 THEN
+			RETURN NULL;
+		END IF;
+
+		target := q * total;
+
+		-- Negative buckets hold the smallest values from the largest index down
+		FOR i IN REVERSE negative_n..1 LOOP
+			IF negative_bucket_counts[i] > 0 AND seen + negative_bucket_counts[i] >= target THEN
+				idx := negative_offset + i - 1;
+				lower_bound := -power(base, idx + 1);
+				upper_bound := -power(base, idx);
+				RETURN lower_bound + (upper_bound - lower_bound) * (target - seen) / negative_bucket_counts[i];
+			END IF;
+			seen := seen + coalesce(negative_bucket_counts[i], 0);
+		END LOOP;
+
+		IF zeros > 0 AND seen + zeros >= target THEN
+			RETURN 0;
+		END IF;
+		seen := seen + zeros;
+
+		FOR i IN 1..positive_n LOOP
+			IF positive_bucket_counts[i] > 0 AND seen + positive_bucket_counts[i] >= target THEN
+				idx := positive_offset + i - 1;
+				lower_bound := power(base, idx);
+				upper_bound := power(base, idx + 1);
+				RETURN lower_bound + (upper_bound - lower_bound) * (target - seen) / positive_bucket_counts[i];
+			END IF;
+			seen := seen + coalesce(positive_bucket_counts[i], 0);
+		END LOOP;
+
+		RETURN NULL;
+	END
+	$$
+	`
+
+	// Same for exponential histograms stored as JSONB arrays
+	createExpHistogramQuantileJSONBFunctionSQL = `
+	CREATE OR REPLACE FUNCTION %[1]s.otel_exp_histogram_quantile(
+		scale INTEGER, zero_count BIGINT,
+		positive_offset INTEGER, positive_bucket_counts JSONB,
+		negative_offset INTEGER, negative_bucket_counts JSONB,
+		q DOUBLE PRECISION
+	)
+	RETURNS DOUBLE PRECISION
+	LANGUAGE sql IMMUTABLE
+	AS $$
+		SELECT %[1]s.otel_exp_histogram_quantile(
+			scale, zero_count,
+			positive_offset, ARRAY(SELECT e::BIGINT FROM jsonb_array_elements_text(positive_bucket_counts) WITH ORDINALITY AS t(e, n) ORDER BY n),
+			negative_offset, ARRAY(SELECT e::BIGINT FROM jsonb_array_elements_text(negative_bucket_counts) WITH ORDINALITY AS t(e, n) ORDER BY n),
+			q
+		)
+	$$
+	`
+)
+
+// Renders the statements creating the quantile functions in the schema, both for
+// buckets stored as native arrays and as JSONB arrays
+func renderCreateQuantileFunctionsSQL(schemaName string) []string {
+	schema := QuoteIdentifier(schemaName)
+
+	return []string{
+		fmt.Sprintf(createHistogramQuantileFunctionSQL, schema),
+		fmt.Sprintf(createHistogramQuantileJSONBFunctionSQL, schema),
+		fmt.Sprintf(createExpHistogramQuantileFunctionSQL, schema),
+		fmt.Sprintf(createExpHistogramQuantileJSONBFunctionSQL, schema),
+	}
+}
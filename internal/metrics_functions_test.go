@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistogramQuantileFunction(t *testing.T) {
+	client, schemaName := openTestSchema(t)
+
+	tests := []struct {
+		name     string
+		bounds   string
+		counts   string
+		q        float64
+		expected sql.NullFloat64
+	}{
+		{name: "first bucket starts at 0", bounds: "[1, 2, 5]", counts: "[2, 3, 5, 0]", q: 0.1, expected: sql.NullFloat64{Float64: 0.5, Valid: true}},
+		{name: "median", bounds: "[1, 2, 5]", counts: "[2, 3, 5, 0]", q: 0.5, expected: sql.NullFloat64{Float64: 2, Valid: true}},
+		{name: "p90", bounds: "[1, 2, 5]", counts: "[2, 3, 5, 0]", q: 0.9, expected: sql.NullFloat64{Float64: 4.4, Valid: true}},
+		{name: "overflow bucket", bounds: "[1, 2, 5]", counts: "[0, 0, 0, 4]", q: 0.5, expected: sql.NullFloat64{Float64: 5, Valid: true}},
+		{name: "negative first bound", bounds: "[-1, 0]", counts: "[4, 0, 0]", q: 0.5, expected: sql.NullFloat64{Float64: -1, Valid: true}},
+		{name: "no observations", bounds: "[1, 2, 5]", counts: "[0, 0, 0, 0]", q: 0.5},
+		{name: "invalid quantile", bounds: "[1, 2, 5]", counts: "[2, 3, 5, 0]", q: 1.5},
+	}
+
+	arrayQuery := fmt.Sprintf(`SELECT %s.otel_histogram_quantile(
+		ARRAY(SELECT jsonb_array_elements_text($1::jsonb)::float8),
+		ARRAY(SELECT jsonb_array_elements_text($2::jsonb)::int8),
+		$3)`, QuoteIdentifier(schemaName))
+	jsonbQuery := fmt.Sprintf(`SELECT %s.otel_histogram_quantile($1::jsonb, $2::jsonb, $3)`, QuoteIdentifier(schemaName))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, query := range []string{arrayQuery, jsonbQuery} {
+				var result sql.NullFloat64
+				require.NoError(t, client.QueryRowContext(context.Background(), query, tt.bounds, tt.counts, tt.q).Scan(&result))
+				assert.Equal(t, tt.expected.Valid, result.Valid)
+				assert.InDelta(t, tt.expected.Float64, result.Float64, 1e-9)
+			}
+		})
+	}
+}
+
+func TestExpHistogramQuantileFunction(t *testing.T) {
+	client, schemaName := openTestSchema(t)
+
+	// Scale 0 has base 2: the negative bucket holds (-2, -1], the positive ones (1, 2] and (2, 4]
+	query := fmt.Sprintf(`SELECT %s.otel_exp_histogram_quantile(0, 1, 0, $1::jsonb, 0, $2::jsonb, $3)`, QuoteIdentifier(schemaName))
+
+	tests := []struct {
+		q        float64
+		expected float64
+	}{
+		{q: 0, expected: -2},
+		{q: 0.25, expected: 0},
+		{q: 0.5, expected: 1.5},
+		{q: 1, expected: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("q=%v", tt.q), func(t *testing.T) {
+			var result sql.NullFloat64
+			require.NoError(t, client.QueryRowContext(context.Background(), query, "[2, 2]", "[1]", tt.q).Scan(&result))
+			require.True(t, result.Valid)
+			assert.InDelta(t, tt.expected, result.Float64, 1e-9)
+		})
+	}
+}
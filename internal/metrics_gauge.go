@@ -3,34 +3,19 @@ package internal
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
-	"errors"
 	"fmt"
 	"slices"
 
-	"github.com/destrex271/postgresexporter/internal/db"
+	"go.opentelemetry.io/collector/consumer/consumererror"
 	"go.opentelemetry.io/collector/pdata/pcommon"
 	"go.opentelemetry.io/collector/pdata/pmetric"
 )
 
-const (
-	gaugeMetricTableInsertSQL = `
-	INSERT INTO "%s"."%s" (
-		resource_url, resource_attributes,
-		scope_name, scope_version, scope_attributes, scope_dropped_attr_count, scope_url, service_name,
-		name, type, description, unit,
-		start_timestamp, timestamp,
-		attribute1, attribute2, attribute3, attribute4, attribute5,
-		attribute6, attribute7, attribute8, attribute9, attribute10,
-		attribute11, attribute12, attribute13, attribute14, attribute15,
-		attribute16, attribute17, attribute18, attribute19, attribute20,
-		metadata,
-		value, exemplars, flags
-	) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16,$17,$18,$19,$20,$21,$22,$23,$24,$25,$26,$27,$28,$29,$30,$31,$32,$33,$34,$35,$36,$37,$38)
-	`
-)
-
 var (
+	gaugeMetricTableValueColumns = []string{
+		"value", "exemplars", "flags",
+	}
+
 	gaugeMetricTableColumns = []string{
 		"value DOUBLE PRECISION",
 
@@ -52,8 +37,7 @@ type gaugeMetric struct {
 type gaugeMetricsGroup struct {
 	MetricsType pmetric.MetricType
 
-	DBType     DBType
-	SchemaName string
+	MetricsSettings
 
 	metrics []*gaugeMetric
 	count   int
@@ -78,126 +62,127 @@ func (g *gaugeMetricsGroup) Add(resMetadata *ResourceMetadata, metric any, name,
 	return nil
 }
 
-func (g *gaugeMetricsGroup) insert(ctx context.Context, client *sql.DB) error {
+// Copies the metric into dest, to send it again
+func (m *gaugeMetric) copyTo(dest pmetric.Metric) {
+	dest.SetName(m.name)
+	dest.SetDescription(m.description)
+	dest.SetUnit(m.unit)
+	m.metadata.CopyTo(dest.Metadata())
+	m.gauge.CopyTo(dest.SetEmptyGauge())
+}
+
+func (g *gaugeMetricsGroup) insert(ctx context.Context, client *sql.DB, failures *metricsFailures) {
 	logger.Debug("Inserting gauge metrics")
 
 	if g.count == 0 {
-		return nil
+		return
 	}
 
-	attributesMappings, err := GetAttributesMappingsByNames(ctx, client, g.SchemaName, g.getMetricsNames())
+	attributesMappingsMap, err := loadAttributesMappings(ctx, client, g.MetricsSettings, g.getMetricsNames())
 	if err != nil {
-		return err
+		for _, m := range g.metrics {
+			failures.fail(m.resMetadata, m.copyTo, err)
+		}
+		return
 	}
 
-	attributesMappingsMap := groupAttrsMappingsByName(attributesMappings)
-
-	var errs error
 	for _, m := range g.metrics {
-		err := db.DoWithTx(ctx, client, func(tx *sql.Tx) error {
-			exists, err := CheckIfTableExists(ctx, client, g.SchemaName, m.name)
+		tableName := g.tableName(g.MetricsType, m.name)
+		err := func() error {
+			table, _, err := ensureMetricTable(ctx, client, g, g.MetricsSettings, g.MetricsType, tableName)
 			if err != nil {
 				return err
 			}
 
-			if !exists {
-				g.createTable(ctx, client, m.name)
+			resAttrs, err := MarshalAttributes(m.resMetadata.ResAttrs)
+			if err != nil {
+				return consumererror.NewPermanent(err)
 			}
 
-			statement, err := tx.PrepareContext(ctx, fmt.Sprintf(gaugeMetricTableInsertSQL, g.SchemaName, m.name))
+			scopeAttrs, err := MarshalAttributes(m.resMetadata.InstrScope.Attributes())
 			if err != nil {
-				return err
+				return consumererror.NewPermanent(err)
 			}
 
-			defer func() {
-				_ = statement.Close()
-			}()
-
-			resAttrs, err := json.Marshal(m.resMetadata.ResAttrs.AsRaw())
+			metadata, err := MarshalAttributes(m.metadata)
 			if err != nil {
-				return err
+				return consumererror.NewPermanent(err)
 			}
 
-			scopeAttrs, err := json.Marshal(m.resMetadata.InstrScope.Attributes().AsRaw())
-			if err != nil {
-				return err
+			dpsAttrs := make([]pcommon.Map, 0, m.gauge.DataPoints().Len())
+			for i := range m.gauge.DataPoints().Len() {
+				dpsAttrs = append(dpsAttrs, m.gauge.DataPoints().At(i).Attributes())
 			}
 
-			metadata, err := json.Marshal(m.metadata.AsRaw())
+			attributes, err := prepareMetricAttributes(ctx, client, g.MetricsSettings, attributesMappingsMap, m.name, tableName, table, dpsAttrs)
 			if err != nil {
 				return err
 			}
 
+			rows := make([][]any, 0, m.gauge.DataPoints().Len())
+			var exemplarRows [][]any
+			serviceName := getServiceName(m.resMetadata.ResAttrs)
 			for i := range m.gauge.DataPoints().Len() {
 				dp := m.gauge.DataPoints().At(i)
 
 				if dp.Timestamp().AsTime().IsZero() {
-					errs = errors.Join(errs, fmt.Errorf("data points with the 0 value for TimeUnixNano SHOULD be rejected by consumers"))
+					failures.reject(fmt.Errorf("data points with the 0 value for TimeUnixNano SHOULD be rejected by consumers"))
 					continue
 				}
 
-				attrsMapping, present := attributesMappingsMap[m.name]
-				if !present {
-					attrsMapping = AttributesMapping{Name: m.name}
-					err = insertAttributesMapping(ctx, client, g.SchemaName, &attrsMapping)
-					if err != nil {
-						errs = errors.Join(errs, err)
-						continue
-					}
-
-					attributesMappingsMap[attrsMapping.Name] = attrsMapping
+				attrs, err := attributes.values(dp.Attributes())
+				if err != nil {
+					failures.reject(err)
+					continue
 				}
 
-				attrs, updated, err := getAttributesAsSliceAndCheckIfUpdated(dp.Attributes(), &attrsMapping)
+				exemplars, err := marshalExemplars(dp.Exemplars())
 				if err != nil {
-					errs = errors.Join(errs, err)
+					failures.reject(err)
 					continue
 				}
 
-				if updated {
-					err = updateAttributesMapping(ctx, client, g.SchemaName, &attrsMapping)
+				if g.ExemplarsTable {
+					exemplarRows, err = appendExemplarRows(exemplarRows, m.name, g.MetricsType, serviceName, dp.Attributes(), dp.Exemplars())
 					if err != nil {
-						errs = errors.Join(errs, err)
+						failures.reject(err)
 						continue
 					}
 				}
 
-				tx.Stmt(statement).ExecContext(ctx,
+				rows = append(rows, g.appendUnixNano(slices.Concat([]any{
 					m.resMetadata.ResURL, resAttrs,
 					m.resMetadata.InstrScope.Name(),
 					m.resMetadata.InstrScope.Version(),
 					scopeAttrs,
 					m.resMetadata.InstrScope.DroppedAttributesCount(),
 					m.resMetadata.ScopeUrl,
-					getServiceName(m.resMetadata.ResAttrs),
+					serviceName,
 					m.name, int32(g.MetricsType), m.description, m.unit,
 					dp.StartTimestamp().AsTime(), dp.Timestamp().AsTime(),
-					attrs[0],  attrs[1],  attrs[2],  attrs[3],  attrs[4],
-					attrs[5],  attrs[6],  attrs[7],  attrs[8],  attrs[9],
-					attrs[10], attrs[11], attrs[12], attrs[13], attrs[14],
-					attrs[15], attrs[16], attrs[17], attrs[18], attrs[19],
+				}, attrs, []any{
 					metadata,
 					getValue(dp.IntValue(), dp.DoubleValue(), dp.ValueType()),
-					dp.Exemplars(),
+					exemplars,
 					uint32(dp.Flags()),
-				)
+				}), dp.StartTimestamp(), dp.Timestamp()))
 			}
 
-			return nil
-		})
-		errs = errors.Join(errs, err)
-	}
-	if errs != nil {
-		return fmt.Errorf("insert gauge metrics failed: %w", errs)
+			columns := g.insertColumns(attributes, gaugeMetricTableValueColumns)
+			return writeMetricRows(ctx, client, g.SchemaName, g.UseCopy,
+				tableRows{table: tableName, columns: columns, rows: rows}, exemplarTableRows(exemplarRows))
+		}()
+		if err != nil {
+			g.Cache.Invalidate(tableName, m.name)
+			failures.fail(m.resMetadata, m.copyTo, fmt.Errorf("insert gauge metric %s failed: %w", m.name, err))
+		}
 	}
-
-	return nil
 }
 
-func (g *gaugeMetricsGroup) createTable(ctx context.Context, client *sql.DB, metricName string) error {
-	metricTableColumns := slices.Concat(getBaseMetricTableColumns(g.DBType), gaugeMetricTableColumns)
+func (g *gaugeMetricsGroup) createTable(ctx context.Context, client *sql.DB, tableName string) error {
+	metricTableColumns := slices.Concat(getBaseMetricTableColumns(g.MetricsSettings), gaugeMetricTableColumns)
 
-	return createMetricTable(ctx, client, g.SchemaName, metricName, metricTableColumns, g.DBType)
+	return createMetricTable(ctx, client, g.MetricsSettings, g.MetricsType, tableName, metricTableColumns)
 }
 
 func (g *gaugeMetricsGroup) getMetricsNames() []string {
@@ -0,0 +1,33 @@
+package internal
+
+import (
+	"go.opentelemetry.io/collector/pdata/pmetric"
+)
+
+// MetricsLayout defines how metrics are spread over tables
+type MetricsLayout string
+
+const (
+	// A table per metric, named after the metric
+	MetricsLayoutTablePerMetric MetricsLayout = "table_per_metric"
+	// A table per metric type shared by all metrics of that type, see wideMetricTableNames
+	MetricsLayoutTablePerType MetricsLayout = "table_per_type"
+
+	createMetricNameIndexSQL = `CREATE INDEX IF NOT EXISTS %s ON %s (name, timestamp)`
+)
+
+var wideMetricTableNames = map[pmetric.MetricType]string{
+	pmetric.MetricTypeGauge:                "otel_metrics_gauge",
+	pmetric.MetricTypeSum:                  "otel_metrics_sum",
+	pmetric.MetricTypeHistogram:            "otel_metrics_histogram",
+	pmetric.MetricTypeExponentialHistogram: "otel_metrics_exponential_histogram",
+	pmetric.MetricTypeSummary:              "otel_metrics_summary",
+}
+
+// Returns the table storing the data points of a metric
+func (s MetricsSettings) tableName(metricsType pmetric.MetricType, metricName string) string {
+	if s.Layout == MetricsLayoutTablePerType {
+		return wideMetricTableNames[metricsType]
+	}
+	return metricName
+}
@@ -0,0 +1,17 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+)
+
+func TestMetricTableName(t *testing.T) {
+	perMetric := MetricsSettings{Layout: MetricsLayoutTablePerMetric}
+	assert.Equal(t, "k8s.pod.cpu.usage", perMetric.tableName(pmetric.MetricTypeGauge, "k8s.pod.cpu.usage"))
+
+	perType := MetricsSettings{Layout: MetricsLayoutTablePerType}
+	assert.Equal(t, "otel_metrics_gauge", perType.tableName(pmetric.MetricTypeGauge, "k8s.pod.cpu.usage"))
+	assert.Equal(t, "otel_metrics_exponential_histogram", perType.tableName(pmetric.MetricTypeExponentialHistogram, "latency"))
+}
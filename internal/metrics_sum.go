@@ -3,34 +3,20 @@ package internal
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"slices"
 
-	"github.com/destrex271/postgresexporter/internal/db"
+	"go.opentelemetry.io/collector/consumer/consumererror"
 	"go.opentelemetry.io/collector/pdata/pcommon"
 	"go.opentelemetry.io/collector/pdata/pmetric"
 )
 
-const (
-	sumMetricTableInsertSQL = `
-	INSERT INTO "%s"."%s" (
-		resource_url, resource_attributes,
-		scope_name, scope_version, scope_attributes, scope_dropped_attr_count, scope_url, service_name,
-		name, type, description, unit,
-		start_timestamp, timestamp,
-		attribute1, attribute2, attribute3, attribute4, attribute5,
-		attribute6, attribute7, attribute8, attribute9, attribute10,
-		attribute11, attribute12, attribute13, attribute14, attribute15,
-		attribute16, attribute17, attribute18, attribute19, attribute20,
-		metadata,
-		value, exemplars, flags, aggregation_temporality, is_monotonic
-	) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16,$17,$18,$19,$20,$21,$22,$23,$24,$25,$26,$27,$28,$29,$30,$31,$32,$33,$34,$35,$36,$37,$38,$39,$40)
-	`
-)
-
 var (
+	sumMetricTableValueColumns = []string{
+		"value", "exemplars", "flags", "aggregation_temporality", "is_monotonic",
+	}
+
 	sumMetricTableColumns = []string{
 		"value DOUBLE PRECISION",
 
@@ -55,8 +41,7 @@ type sumMetric struct {
 type sumMetricsGroup struct {
 	MetricsType pmetric.MetricType
 
-	DBType     DBType
-	SchemaName string
+	MetricsSettings
 
 	metrics []*sumMetric
 	count   int
@@ -81,130 +66,166 @@ func (g *sumMetricsGroup) Add(resMetadata *ResourceMetadata, metric any, name, d
 	return nil
 }
 
-func (g *sumMetricsGroup) insert(ctx context.Context, client *sql.DB) error {
+// Copies the metric into dest, to send it again
+func (m *sumMetric) copyTo(dest pmetric.Metric) {
+	dest.SetName(m.name)
+	dest.SetDescription(m.description)
+	dest.SetUnit(m.unit)
+	m.metadata.CopyTo(dest.Metadata())
+	m.sum.CopyTo(dest.SetEmptySum())
+}
+
+func (g *sumMetricsGroup) insert(ctx context.Context, client *sql.DB, failures *metricsFailures) {
 	logger.Debug("Inserting sum metrics")
 
 	if g.count == 0 {
-		return nil
+		return
 	}
 
-	attributesMappings, err := GetAttributesMappingsByNames(ctx, client, g.SchemaName, g.getMetricsNames())
+	attributesMappingsMap, err := loadAttributesMappings(ctx, client, g.MetricsSettings, g.getMetricsNames())
 	if err != nil {
-		return err
+		for _, m := range g.metrics {
+			failures.fail(m.resMetadata, m.copyTo, err)
+		}
+		return
 	}
 
-	attributesMappingsMap := groupAttrsMappingsByName(attributesMappings)
-
-	var errs error
 	for _, m := range g.metrics {
-		err := db.DoWithTx(ctx, client, func(tx *sql.Tx) error {
-			exists, err := CheckIfTableExists(ctx, client, g.SchemaName, m.name)
+		tableName := g.tableName(g.MetricsType, m.name)
+		err := func() error {
+			table, _, err := ensureMetricTable(ctx, client, g, g.MetricsSettings, g.MetricsType, tableName)
 			if err != nil {
 				return err
 			}
 
-			if !exists {
-				g.createTable(ctx, client, m.name)
+			resAttrs, err := MarshalAttributes(m.resMetadata.ResAttrs)
+			if err != nil {
+				return consumererror.NewPermanent(err)
 			}
 
-			statement, err := tx.PrepareContext(ctx, fmt.Sprintf(sumMetricTableInsertSQL, g.SchemaName, m.name))
+			scopeAttrs, err := MarshalAttributes(m.resMetadata.InstrScope.Attributes())
 			if err != nil {
-				return err
+				return consumererror.NewPermanent(err)
 			}
 
-			defer func() {
-				_ = statement.Close()
-			}()
-
-			resAttrs, err := json.Marshal(m.resMetadata.ResAttrs.AsRaw())
+			metadata, err := MarshalAttributes(m.metadata)
 			if err != nil {
-				return err
+				return consumererror.NewPermanent(err)
+			}
+
+			dpsAttrs := make([]pcommon.Map, 0, m.sum.DataPoints().Len())
+			for i := range m.sum.DataPoints().Len() {
+				dpsAttrs = append(dpsAttrs, m.sum.DataPoints().At(i).Attributes())
 			}
 
-			scopeAttrs, err := json.Marshal(m.resMetadata.InstrScope.Attributes().AsRaw())
+			attributes, err := prepareMetricAttributes(ctx, client, g.MetricsSettings, attributesMappingsMap, m.name, tableName, table, dpsAttrs)
 			if err != nil {
 				return err
 			}
 
-			metadata, err := json.Marshal(m.metadata.AsRaw())
+			// The series are claimed from here until their rows are written, other sums aren't held up
+			var keys []string
+			var keyErrs []error
+			if g.SumNormalizer != nil {
+				keys, keyErrs = sumSeriesKeys(m.name, resAttrs, m.resMetadata.InstrScope, dpsAttrs)
+			}
+
+			conversion, err := g.SumNormalizer.begin(ctx, keys)
 			if err != nil {
 				return err
 			}
+			defer conversion.end()
 
+			rows := make([][]any, 0, m.sum.DataPoints().Len())
+			var exemplarRows [][]any
+			serviceName := getServiceName(m.resMetadata.ResAttrs)
 			for i := range m.sum.DataPoints().Len() {
 				dp := m.sum.DataPoints().At(i)
 
 				if dp.Timestamp().AsTime().IsZero() {
-					errs = errors.Join(errs, fmt.Errorf("data points with the 0 value for TimeUnixNano SHOULD be rejected by consumers"))
+					failures.reject(fmt.Errorf("data points with the 0 value for TimeUnixNano SHOULD be rejected by consumers"))
 					continue
 				}
 
-				attrsMapping, present := attributesMappingsMap[m.name]
-				if !present {
-					attrsMapping = AttributesMapping{Name: m.name}
-					err = insertAttributesMapping(ctx, client, g.SchemaName, &attrsMapping)
-					if err != nil {
-						errs = errors.Join(errs, err)
+				attrs, err := attributes.values(dp.Attributes())
+				if err != nil {
+					failures.reject(err)
+					continue
+				}
+
+				start, value := dp.StartTimestamp(), getValue(dp.IntValue(), dp.DoubleValue(), dp.ValueType())
+				if conversion != nil {
+					if keyErrs[i] != nil {
+						failures.reject(keyErrs[i])
 						continue
 					}
 
-					attributesMappingsMap[attrsMapping.Name] = attrsMapping
+					start, value, err = conversion.convert(keys[i], m.sum, dp)
+					if errors.Is(err, errSumBaseline) {
+						continue
+					}
+					if err != nil {
+						failures.reject(fmt.Errorf("sum metric %s: %w", m.name, err))
+						continue
+					}
 				}
 
-				attrs, updated, err := getAttributesAsSliceAndCheckIfUpdated(dp.Attributes(), &attrsMapping)
+				exemplars, err := marshalExemplars(dp.Exemplars())
 				if err != nil {
-					errs = errors.Join(errs, err)
+					failures.reject(err)
 					continue
 				}
 
-				if updated {
-					err = updateAttributesMapping(ctx, client, g.SchemaName, &attrsMapping)
+				if g.ExemplarsTable {
+					exemplarRows, err = appendExemplarRows(exemplarRows, m.name, g.MetricsType, serviceName, dp.Attributes(), dp.Exemplars())
 					if err != nil {
-						errs = errors.Join(errs, err)
+						failures.reject(err)
 						continue
 					}
-
-					attributesMappingsMap[attrsMapping.Name] = attrsMapping
 				}
 
-				tx.Stmt(statement).ExecContext(ctx,
+				rows = append(rows, g.appendUnixNano(slices.Concat([]any{
 					m.resMetadata.ResURL, resAttrs,
 					m.resMetadata.InstrScope.Name(),
 					m.resMetadata.InstrScope.Version(),
 					scopeAttrs,
 					m.resMetadata.InstrScope.DroppedAttributesCount(),
 					m.resMetadata.ScopeUrl,
-					getServiceName(m.resMetadata.ResAttrs),
+					serviceName,
 					m.name, int32(g.MetricsType), m.description, m.unit,
-					dp.StartTimestamp().AsTime(), dp.Timestamp().AsTime(),
-					attrs[0],  attrs[1],  attrs[2],  attrs[3],  attrs[4],
-					attrs[5],  attrs[6],  attrs[7],  attrs[8],  attrs[9],
-					attrs[10], attrs[11], attrs[12], attrs[13], attrs[14],
-					attrs[15], attrs[16], attrs[17], attrs[18], attrs[19],
+					start.AsTime(), dp.Timestamp().AsTime(),
+				}, attrs, []any{
 					metadata,
-					getValue(dp.IntValue(), dp.DoubleValue(), dp.ValueType()),
-					dp.Exemplars(),
+					value,
+					exemplars,
 					uint32(dp.Flags()),
-					int32(m.sum.AggregationTemporality()),
+					int32(conversion.temporality(m.sum)),
 					m.sum.IsMonotonic(),
-				)
+				}), start, dp.Timestamp()))
+			}
+
+			columns := g.insertColumns(attributes, sumMetricTableValueColumns)
+			err = writeMetricRows(ctx, client, g.SchemaName, g.UseCopy,
+				tableRows{table: tableName, columns: columns, rows: rows}, exemplarTableRows(exemplarRows))
+			if err != nil {
+				return err
 			}
 
+			// Series advance only once their data points are stored, a retried batch is converted again
+			conversion.commit()
 			return nil
-		})
-		errs = errors.Join(errs, err)
-	}
-	if errs != nil {
-		return fmt.Errorf("insert sum metrics failed: %w", errs)
+		}()
+		if err != nil {
+			g.Cache.Invalidate(tableName, m.name)
+			failures.fail(m.resMetadata, m.copyTo, fmt.Errorf("insert sum metric %s failed: %w", m.name, err))
+		}
 	}
-
-	return nil
 }
 
-func (g *sumMetricsGroup) createTable(ctx context.Context, client *sql.DB, metricName string) error {
-	metricTableColumns := slices.Concat(getBaseMetricTableColumns(g.DBType), sumMetricTableColumns)
+func (g *sumMetricsGroup) createTable(ctx context.Context, client *sql.DB, tableName string) error {
+	metricTableColumns := slices.Concat(getBaseMetricTableColumns(g.MetricsSettings), sumMetricTableColumns)
 
-	return createMetricTable(ctx, client, g.SchemaName, metricName, metricTableColumns, g.DBType)
+	return createMetricTable(ctx, client, g.MetricsSettings, g.MetricsType, tableName, metricTableColumns)
 }
 
 func (g *sumMetricsGroup) getMetricsNames() []string {
@@ -4,33 +4,19 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"slices"
 
-	"github.com/destrex271/postgresexporter/internal/db"
+	"go.opentelemetry.io/collector/consumer/consumererror"
 	"go.opentelemetry.io/collector/pdata/pcommon"
 	"go.opentelemetry.io/collector/pdata/pmetric"
 )
 
-const (
-	summaryMetricTableInsertSQL = `
-	INSERT INTO "%s"."%s" (
-		resource_url, resource_attributes,
-		scope_name, scope_version, scope_attributes, scope_dropped_attr_count, scope_url, service_name,
-		name, type, description, unit,
-		start_timestamp, timestamp,
-		attribute1, attribute2, attribute3, attribute4, attribute5,
-		attribute6, attribute7, attribute8, attribute9, attribute10,
-		attribute11, attribute12, attribute13, attribute14, attribute15,
-		attribute16, attribute17, attribute18, attribute19, attribute20,
-		metadata,
-		count, sum, quantile_values, flags
-	) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16,$17,$18,$19,$20,$21,$22,$23,$24,$25,$26,$27,$28,$29,$30,$31,$32,$33,$34,$35,$36,$37,$38,$39)
-	`
-)
-
 var (
+	summaryMetricTableValueColumns = []string{
+		"count", "sum", "quantile_values", "flags",
+	}
+
 	summaryMetricTableColumns = []string{
 		"count BIGINT",
 		"sum   DOUBLE PRECISION",
@@ -38,6 +24,20 @@ var (
 		"quantile_values JSONB",
 		"flags           INTEGER",
 	}
+
+	// With MetricsSettings.NativeArrays quantiles and their values are stored in separate arrays
+	summaryMetricTableNativeArraysValueColumns = []string{
+		"count", "sum", "quantiles", "quantile_values", "flags",
+	}
+
+	summaryMetricTableNativeArraysColumns = []string{
+		"count BIGINT",
+		"sum   DOUBLE PRECISION",
+
+		"quantiles       DOUBLE PRECISION[]",
+		"quantile_values DOUBLE PRECISION[]",
+		"flags           INTEGER",
+	}
 )
 
 type summaryMetric struct {
@@ -53,8 +53,7 @@ type summaryMetric struct {
 type summaryMetricsGroup struct {
 	MetricsType pmetric.MetricType
 
-	DBType     DBType
-	SchemaName string
+	MetricsSettings
 
 	metrics []*summaryMetric
 	count   int
@@ -79,97 +78,85 @@ func (g *summaryMetricsGroup) Add(resMetadata *ResourceMetadata, metric any, nam
 	return nil
 }
 
-func (g *summaryMetricsGroup) insert(ctx context.Context, client *sql.DB) error {
+// Copies the metric into dest, to send it again
+func (m *summaryMetric) copyTo(dest pmetric.Metric) {
+	dest.SetName(m.name)
+	dest.SetDescription(m.description)
+	dest.SetUnit(m.unit)
+	m.metadata.CopyTo(dest.Metadata())
+	m.summary.CopyTo(dest.SetEmptySummary())
+}
+
+func (g *summaryMetricsGroup) insert(ctx context.Context, client *sql.DB, failures *metricsFailures) {
 	logger.Debug("Inserting summary metrics")
 
 	if g.count == 0 {
-		return nil
+		return
 	}
 
-	attributesMappings, err := GetAttributesMappingsByNames(ctx, client, g.SchemaName, g.getMetricsNames())
+	attributesMappingsMap, err := loadAttributesMappings(ctx, client, g.MetricsSettings, g.getMetricsNames())
 	if err != nil {
-		return err
+		for _, m := range g.metrics {
+			failures.fail(m.resMetadata, m.copyTo, err)
+		}
+		return
 	}
 
-	attributesMappingsMap := groupAttrsMappingsByName(attributesMappings)
-
-	var errs error
 	for _, m := range g.metrics {
-		err := db.DoWithTx(ctx, client, func(tx *sql.Tx) error {
-			exists, err := CheckIfTableExists(ctx, client, g.SchemaName, m.name)
+		tableName := g.tableName(g.MetricsType, m.name)
+		err := func() error {
+			table, _, err := ensureMetricTable(ctx, client, g, g.MetricsSettings, g.MetricsType, tableName)
 			if err != nil {
 				return err
 			}
 
-			if !exists {
-				g.createTable(ctx, client, m.name)
+			resAttrs, err := MarshalAttributes(m.resMetadata.ResAttrs)
+			if err != nil {
+				return consumererror.NewPermanent(err)
 			}
 
-			statement, err := tx.PrepareContext(ctx, fmt.Sprintf(summaryMetricTableInsertSQL, g.SchemaName, m.name))
+			scopeAttrs, err := MarshalAttributes(m.resMetadata.InstrScope.Attributes())
 			if err != nil {
-				return err
+				return consumererror.NewPermanent(err)
 			}
 
-			defer func() {
-				_ = statement.Close()
-			}()
-
-			resAttrs, err := json.Marshal(m.resMetadata.ResAttrs.AsRaw())
+			metadata, err := MarshalAttributes(m.metadata)
 			if err != nil {
-				return err
+				return consumererror.NewPermanent(err)
 			}
 
-			scopeAttrs, err := json.Marshal(m.resMetadata.InstrScope.Attributes().AsRaw())
-			if err != nil {
-				return err
+			dpsAttrs := make([]pcommon.Map, 0, m.summary.DataPoints().Len())
+			for i := range m.summary.DataPoints().Len() {
+				dpsAttrs = append(dpsAttrs, m.summary.DataPoints().At(i).Attributes())
 			}
 
-			metadata, err := json.Marshal(m.metadata.AsRaw())
+			attributes, err := prepareMetricAttributes(ctx, client, g.MetricsSettings, attributesMappingsMap, m.name, tableName, table, dpsAttrs)
 			if err != nil {
 				return err
 			}
 
+			rows := make([][]any, 0, m.summary.DataPoints().Len())
 			for i := range m.summary.DataPoints().Len() {
 				dp := m.summary.DataPoints().At(i)
 
 				if dp.Timestamp().AsTime().IsZero() {
-					errs = errors.Join(errs, fmt.Errorf("data points with the 0 value for TimeUnixNano SHOULD be rejected by consumers"))
+					failures.reject(fmt.Errorf("data points with the 0 value for TimeUnixNano SHOULD be rejected by consumers"))
 					continue
 				}
 
-				attrsMapping, present := attributesMappingsMap[m.name]
-				if !present {
-					attrsMapping = AttributesMapping{Name: m.name}
-					err = insertAttributesMapping(ctx, client, g.SchemaName, &attrsMapping)
-					if err != nil {
-						errs = errors.Join(errs, err)
-						continue
-					}
-
-					attributesMappingsMap[attrsMapping.Name] = attrsMapping
-				}
-
-				attrs, updated, err := getAttributesAsSliceAndCheckIfUpdated(dp.Attributes(), &attrsMapping)
+				attrs, err := attributes.values(dp.Attributes())
 				if err != nil {
-					errs = errors.Join(errs, err)
+					failures.reject(err)
 					continue
 				}
 
-				if updated {
-					err = updateAttributesMapping(ctx, client, g.SchemaName, &attrsMapping)
-					if err != nil {
-						errs = errors.Join(errs, err)
-						continue
-					}
-				}
-
-				quantileValues, err := json.Marshal(convertValueAtQuantileSliceToMap(dp.QuantileValues()))
+				values, err := quantileValues(table, dp.QuantileValues())
 				if err != nil {
-					errs = errors.Join(errs, err)
+					failures.reject(err)
 					continue
 				}
 
-				tx.Stmt(statement).ExecContext(ctx,
+				rows = append(rows, g.appendUnixNano(slices.Concat([]any{
 					m.resMetadata.ResURL, resAttrs,
 					m.resMetadata.InstrScope.Name(),
 					m.resMetadata.InstrScope.Version(),
@@ -179,33 +166,39 @@ func (g *summaryMetricsGroup) insert(ctx context.Context, client *sql.DB) error
 					getServiceName(m.resMetadata.ResAttrs),
 					m.name, int32(g.MetricsType), m.description, m.unit,
 					dp.StartTimestamp().AsTime(), dp.Timestamp().AsTime(),
-					attrs[0],  attrs[1],  attrs[2],  attrs[3],  attrs[4],
-					attrs[5],  attrs[6],  attrs[7],  attrs[8],  attrs[9],
-					attrs[10], attrs[11], attrs[12], attrs[13], attrs[14],
-					attrs[15], attrs[16], attrs[17], attrs[18], attrs[19],
+				}, attrs, []any{
 					metadata,
 					dp.Count(),
 					dp.Sum(),
-					quantileValues,
+				}, values, []any{
 					uint32(dp.Flags()),
-				)
+				}), dp.StartTimestamp(), dp.Timestamp()))
 			}
 
-			return nil
-		})
-		errs = errors.Join(errs, err)
-	}
-	if errs != nil {
-		return fmt.Errorf("insert summary metrics failed: %w", errs)
-	}
+			valueColumns := summaryMetricTableValueColumns
+			if table.nativeArrays {
+				valueColumns = summaryMetricTableNativeArraysValueColumns
+			}
 
-	return nil
+			columns := g.insertColumns(attributes, valueColumns)
+			return writeMetricRows(ctx, client, g.SchemaName, g.UseCopy, tableRows{table: tableName, columns: columns, rows: rows})
+		}()
+		if err != nil {
+			g.Cache.Invalidate(tableName, m.name)
+			failures.fail(m.resMetadata, m.copyTo, fmt.Errorf("insert summary metric %s failed: %w", m.name, err))
+		}
+	}
 }
 
-func (g *summaryMetricsGroup) createTable(ctx context.Context, client *sql.DB, metricName string) error {
-	metricTableColumns := slices.Concat(getBaseMetricTableColumns(g.DBType), summaryMetricTableColumns)
+func (g *summaryMetricsGroup) createTable(ctx context.Context, client *sql.DB, tableName string) error {
+	valueColumns := summaryMetricTableColumns
+	if g.NativeArrays {
+		valueColumns = summaryMetricTableNativeArraysColumns
+	}
+
+	metricTableColumns := slices.Concat(getBaseMetricTableColumns(g.MetricsSettings), valueColumns)
 
-	return createMetricTable(ctx, client, g.SchemaName, metricName, metricTableColumns, g.DBType)
+	return createMetricTable(ctx, client, g.MetricsSettings, g.MetricsType, tableName, metricTableColumns)
 }
 
 func (g *summaryMetricsGroup) getMetricsNames() []string {
@@ -218,6 +211,27 @@ func (g *summaryMetricsGroup) getMetricsNames() []string {
 	return result
 }
 
+// Returns the values of the quantile columns of the table, a JSONB object or the quantiles and values as arrays
+func quantileValues(table metricTable, slice pmetric.SummaryDataPointValueAtQuantileSlice) ([]any, error) {
+	if table.nativeArrays {
+		quantiles := make([]float64, slice.Len())
+		values := make([]float64, slice.Len())
+		for i := range slice.Len() {
+			quantiles[i] = slice.At(i).Quantile()
+			values[i] = slice.At(i).Value()
+		}
+
+		return []any{quantiles, values}, nil
+	}
+
+	quantileValues, err := json.Marshal(convertValueAtQuantileSliceToMap(slice))
+	if err != nil {
+		return nil, err
+	}
+
+	return []any{quantileValues}, nil
+}
+
 func convertValueAtQuantileSliceToMap(slice pmetric.SummaryDataPointValueAtQuantileSlice) map[string][]float64 {
 	var (
 		quantiles []float64
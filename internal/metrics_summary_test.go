@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+)
+
+func TestSummaryQuantileValues(t *testing.T) {
+	slice := pmetric.NewSummaryDataPointValueAtQuantileSlice()
+	for _, qv := range [][2]float64{{0.5, 12}, {0.99, 80}} {
+		v := slice.AppendEmpty()
+		v.SetQuantile(qv[0])
+		v.SetValue(qv[1])
+	}
+
+	values, err := quantileValues(metricTable{}, slice)
+	require.NoError(t, err)
+	require.Len(t, values, 1)
+	assert.JSONEq(t, `{"quantiles": [0.5, 0.99], "values": [12, 80]}`, string(values[0].([]byte)))
+
+	values, err = quantileValues(metricTable{nativeArrays: true}, slice)
+	require.NoError(t, err)
+	assert.Equal(t, []any{[]float64{0.5, 0.99}, []float64{12, 80}}, values)
+}
+
+func TestNativeArrayColumns(t *testing.T) {
+	settings := MetricsSettings{}
+	assert.Contains(t, histogramMetricTableColumns(settings), "bucket_counts   JSONB")
+
+	value, err := metricTable{}.arrayValue([]uint64{1, 2})
+	require.NoError(t, err)
+	assert.Equal(t, []byte("[1,2]"), value)
+
+	settings.NativeArrays = true
+	assert.Contains(t, histogramMetricTableColumns(settings), "bucket_counts   BIGINT[]")
+	assert.Contains(t, histogramMetricTableColumns(settings), "explicit_bounds DOUBLE PRECISION[]")
+	assert.Contains(t, expHistogramMetricTableColumns(settings), "positive_bucket_counts BIGINT[]")
+
+	value, err = metricTable{nativeArrays: true}.arrayValue([]uint64{1, 2})
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{1, 2}, value)
+}
+
+func TestEnsureMetricTableKeepsArrayStorage(t *testing.T) {
+	client, schemaName := openTestSchema(t)
+	ctx := context.Background()
+
+	for _, tt := range []struct {
+		metricsType pmetric.MetricType
+		group       func(settings MetricsSettings) MetricsGroup
+	}{
+		{metricsType: pmetric.MetricTypeHistogram, group: func(settings MetricsSettings) MetricsGroup {
+			return &histogramMetricsGroup{MetricsType: pmetric.MetricTypeHistogram, MetricsSettings: settings}
+		}},
+		{metricsType: pmetric.MetricTypeExponentialHistogram, group: func(settings MetricsSettings) MetricsGroup {
+			return &expHistogramMetricsGroup{MetricsType: pmetric.MetricTypeExponentialHistogram, MetricsSettings: settings}
+		}},
+		{metricsType: pmetric.MetricTypeSummary, group: func(settings MetricsSettings) MetricsGroup {
+			return &summaryMetricsGroup{MetricsType: pmetric.MetricTypeSummary, MetricsSettings: settings}
+		}},
+	} {
+		t.Run(tt.metricsType.String(), func(t *testing.T) {
+			for _, nativeArrays := range []bool{false, true} {
+				tableName := fmt.Sprintf("%s.native_%t", tt.metricsType, nativeArrays)
+				settings := MetricsSettings{SchemaName: schemaName, NativeArrays: nativeArrays, Cache: NewMetricsCache()}
+
+				table, created, err := ensureMetricTable(ctx, client, tt.group(settings), settings, tt.metricsType, tableName)
+				require.NoError(t, err)
+				assert.True(t, created)
+				assert.Equal(t, nativeArrays, table.nativeArrays)
+
+				// After the setting changed the table keeps the storage it was created with
+				settings.NativeArrays = !nativeArrays
+				settings.Cache = NewMetricsCache()
+				table, created, err = ensureMetricTable(ctx, client, tt.group(settings), settings, tt.metricsType, tableName)
+				require.NoError(t, err)
+				assert.False(t, created)
+				assert.Equal(t, nativeArrays, table.nativeArrays)
+			}
+		})
+	}
+}
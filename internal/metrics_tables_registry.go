@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"go.opentelemetry.io/collector/pdata/pmetric"
+)
+
+const (
+	// Every metric table created by the exporter is recorded here, so background
+	// maintenance can find them without receiving data for every metric first
+	MetricTablesRegistryTableName = "_metric_tables"
+
+	createMetricTablesRegistrySQL = `
+	CREATE TABLE IF NOT EXISTS %s (
+		name       VARCHAR PRIMARY KEY,
+		type       INTEGER,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)
+	`
+
+	// Tables created before the registry existed are found through the attributes mappings
+	backfillMetricTablesRegistrySQL = `
+	INSERT INTO %s (name)
+	SELECT m.name FROM %s m
+	WHERE to_regclass(%s || '.' || quote_ident(m.name)) IS NOT NULL
+	ON CONFLICT (name) DO NOTHING
+	`
+
+	// Backfilled tables have no type until the exporter first writes to them after starting
+	registerMetricTableSQL = `
+	INSERT INTO %[1]s AS t (name, type) VALUES ($1, $2)
+	ON CONFLICT (name) DO UPDATE SET type = EXCLUDED.type WHERE t.type IS NULL
+	`
+)
+
+func renderCreateMetricTablesRegistrySQL(schemaName string) string {
+	return fmt.Sprintf(createMetricTablesRegistrySQL, QuoteIdentifier(schemaName, MetricTablesRegistryTableName))
+}
+
+func registerMetricTable(ctx context.Context, client sqlExecutor, schemaName, metricName string, metricsType pmetric.MetricType) error {
+	query := fmt.Sprintf(registerMetricTableSQL, QuoteIdentifier(schemaName, MetricTablesRegistryTableName))
+	_, err := client.ExecContext(ctx, query, metricName, int32(metricsType))
+
+	return err
+}
+
+// Metric table recorded in the registry. The type is MetricTypeEmpty for
+// backfilled tables that haven't received data since.
+type registeredMetricTable struct {
+	name        string
+	metricsType pmetric.MetricType
+}
+
+func getRegisteredMetricTables(ctx context.Context, client *sql.DB, schemaName string) ([]registeredMetricTable, error) {
+	query := fmt.Sprintf(`SELECT name, COALESCE(type, 0) FROM %s ORDER BY name`, QuoteIdentifier(schemaName, MetricTablesRegistryTableName))
+	rows, err := client.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tables []registeredMetricTable
+	for rows.Next() {
+		var table registeredMetricTable
+		if err := rows.Scan(&table.name, &table.metricsType); err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+
+	return tables, rows.Err()
+}
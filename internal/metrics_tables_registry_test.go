@@ -0,0 +1,38 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+)
+
+func TestEnsureMetricTableRegistersBackfilledTable(t *testing.T) {
+	client, schemaName := openTestSchema(t)
+	ctx := context.Background()
+
+	// A table created before the registry existed is backfilled without a type
+	_, err := client.ExecContext(ctx, fmt.Sprintf("CREATE TABLE %s (value DOUBLE PRECISION)", QuoteIdentifier(schemaName, "backfilled.metric")))
+	require.NoError(t, err)
+	_, err = client.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (name) VALUES ($1)", QuoteIdentifier(schemaName, MetricTablesRegistryTableName)), "backfilled.metric")
+	require.NoError(t, err)
+
+	settings := MetricsSettings{SchemaName: schemaName, Cache: NewMetricsCache()}
+	group := &gaugeMetricsGroup{MetricsType: pmetric.MetricTypeGauge, MetricsSettings: settings}
+
+	_, created, err := ensureMetricTable(ctx, client, group, settings, pmetric.MetricTypeGauge, "backfilled.metric")
+	require.NoError(t, err)
+	assert.False(t, created)
+
+	// The type of a registered table isn't overwritten
+	settings.Cache = NewMetricsCache()
+	_, _, err = ensureMetricTable(ctx, client, group, settings, pmetric.MetricTypeSum, "backfilled.metric")
+	require.NoError(t, err)
+
+	tables, err := getRegisteredMetricTables(ctx, client, schemaName)
+	require.NoError(t, err)
+	assert.Contains(t, tables, registeredMetricTable{name: "backfilled.metric", metricsType: pmetric.MetricTypeGauge})
+}
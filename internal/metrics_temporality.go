@@ -0,0 +1,258 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+)
+
+// How long the state of a series without data points is kept
+const sumSeriesTTL = time.Hour
+
+// SumTemporality defines the aggregation temporality sums are stored with
+type SumTemporality string
+
+const (
+	// Store sums with the temporality they're received with
+	SumTemporalityAsReceived SumTemporality = "as_received"
+	// Convert delta sums to cumulative ones
+	SumTemporalityCumulative SumTemporality = "cumulative"
+	// Convert cumulative sums to delta ones
+	SumTemporalityDelta SumTemporality = "delta"
+)
+
+// State of a converted series
+type sumSeries struct {
+	// Start of the series as received, a different start means the series was reset
+	start pcommon.Timestamp
+	// Timestamp and cumulative value of the latest data point
+	last  pcommon.Timestamp
+	value float64
+	// Start of the cumulative series written for delta input
+	cumulativeStart pcommon.Timestamp
+
+	updatedAt time.Time
+}
+
+// SumNormalizer converts sums to a single temporality, so delta and cumulative producers can share a table.
+// It keeps the state of every series, identified by the metric name, resource, scope and data point attributes,
+// across batches. It's safe for concurrent use and a nil normalizer converts nothing.
+type SumNormalizer struct {
+	target pmetric.AggregationTemporality
+
+	mu     sync.Mutex
+	series map[string]sumSeries
+	// Series of conversions that are being written, the channel is closed when the conversion ends
+	pending map[string]chan struct{}
+}
+
+// NewSumNormalizer returns a normalizer converting sums to the temporality, or nil to keep sums as received
+func NewSumNormalizer(temporality SumTemporality) *SumNormalizer {
+	var target pmetric.AggregationTemporality
+	switch temporality {
+	case SumTemporalityCumulative:
+		target = pmetric.AggregationTemporalityCumulative
+	case SumTemporalityDelta:
+		target = pmetric.AggregationTemporalityDelta
+	default:
+		return nil
+	}
+
+	return &SumNormalizer{target: target, series: map[string]sumSeries{}, pending: map[string]chan struct{}{}}
+}
+
+// Expire forgets the series without data points for sumSeriesTTL. A series that comes back starts over
+// like a new one.
+func (n *SumNormalizer) Expire(now time.Time) {
+	if n == nil {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for key, series := range n.series {
+		if series.updatedAt.Before(now.Add(-sumSeriesTTL)) {
+			delete(n.series, key)
+		}
+	}
+}
+
+// Starts the conversion of the series with the keys. The series are claimed until the conversion ends,
+// so a concurrent batch with one of them waits for the written state instead of converting from a stale one.
+// All series are claimed at once, a conversion never waits while holding some. Batches with other series
+// aren't blocked, the normalizer is only locked while series are claimed, converted and committed.
+// Empty keys, of data points without a series key, are ignored.
+func (n *SumNormalizer) begin(ctx context.Context, keys []string) (*sumConversion, error) {
+	if n == nil {
+		return nil, nil
+	}
+	keys = slices.DeleteFunc(slices.Clone(keys), func(key string) bool { return key == "" })
+
+	for {
+		n.mu.Lock()
+		var wait chan struct{}
+		for _, key := range keys {
+			if done, present := n.pending[key]; present {
+				wait = done
+				break
+			}
+		}
+
+		if wait == nil {
+			c := &sumConversion{normalizer: n, keys: keys, done: make(chan struct{}), updates: map[string]sumSeries{}}
+			for _, key := range keys {
+				n.pending[key] = c.done
+			}
+			n.mu.Unlock()
+			return c, nil
+		}
+		n.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// sumConversion holds the series updated by converted data points
+// until they are written, so data points that fail to be written can be converted again
+type sumConversion struct {
+	normalizer *SumNormalizer
+	keys       []string
+	done       chan struct{}
+	updates    map[string]sumSeries
+}
+
+// Returns the temporality the data points of a sum are written with
+func (c *sumConversion) temporality(sum pmetric.Sum) pmetric.AggregationTemporality {
+	if c == nil || sum.AggregationTemporality() == pmetric.AggregationTemporalityUnspecified {
+		return sum.AggregationTemporality()
+	}
+	return c.normalizer.target
+}
+
+// Converts a data point of a series claimed by begin to the target temporality. Returns the start timestamp
+// and the value to write, or an error if the data point is older than the latest one of its series.
+func (c *sumConversion) convert(key string, sum pmetric.Sum, dp pmetric.NumberDataPoint) (pcommon.Timestamp, float64, error) {
+	value := getValue(dp.IntValue(), dp.DoubleValue(), dp.ValueType())
+	if c == nil || c.temporality(sum) == sum.AggregationTemporality() {
+		return dp.StartTimestamp(), value, nil
+	}
+
+	series, present := c.updates[key]
+	if !present {
+		c.normalizer.mu.Lock()
+		series, present = c.normalizer.series[key]
+		c.normalizer.mu.Unlock()
+	}
+
+	if present && dp.Timestamp() <= series.last {
+		return 0, 0, fmt.Errorf("out of order data point at %s, the series is at %s already", dp.Timestamp(), series.last)
+	}
+
+	var start pcommon.Timestamp
+	switch c.normalizer.target {
+	case pmetric.AggregationTemporalityCumulative:
+		// Delta data points add up from the first one seen
+		if !present {
+			series = sumSeries{cumulativeStart: dp.StartTimestamp()}
+		}
+		series.value += value
+		start, value = series.cumulativeStart, series.value
+
+	case pmetric.AggregationTemporalityDelta:
+		switch {
+		case !present && dp.StartTimestamp() == 0:
+			// Without a start timestamp the first data point only sets the baseline
+			c.updates[key] = sumSeries{last: dp.Timestamp(), value: value, updatedAt: time.Now()}
+			return 0, 0, errSumBaseline
+
+		case !present || dp.StartTimestamp() != series.start:
+			// The first data point or a restart with a new start timestamp counts from its start
+			start = dp.StartTimestamp()
+			if start == 0 {
+				start = series.last
+			}
+			series.value = value
+
+		case sum.IsMonotonic() && value < series.value:
+			// A counter dropping without a new start timestamp was reset since the previous data point
+			start = series.last
+			series.value = value
+
+		default:
+			start = series.last
+			value, series.value = value-series.value, value
+		}
+	}
+
+	series.start, series.last, series.updatedAt = dp.StartTimestamp(), dp.Timestamp(), time.Now()
+	c.updates[key] = series
+
+	return start, value, nil
+}
+
+// Stores the updated series, after the converted data points were written
+func (c *sumConversion) commit() {
+	if c == nil {
+		return
+	}
+
+	c.normalizer.mu.Lock()
+	defer c.normalizer.mu.Unlock()
+
+	for key, series := range c.updates {
+		c.normalizer.series[key] = series
+	}
+}
+
+// Releases the series, waking up the conversions waiting for them
+func (c *sumConversion) end() {
+	if c == nil {
+		return
+	}
+
+	c.normalizer.mu.Lock()
+	defer c.normalizer.mu.Unlock()
+
+	for _, key := range c.keys {
+		if c.normalizer.pending[key] == c.done {
+			delete(c.normalizer.pending, key)
+		}
+	}
+	close(c.done)
+}
+
+// Returned for the first data point of a cumulative series without a start timestamp,
+// which has no delta to write
+var errSumBaseline = fmt.Errorf("first data point of the series without start timestamp")
+
+// Returns the series keys of data points, or the errors of data points whose attributes can't be encoded
+func sumSeriesKeys(metricName string, resAttrs []byte, scope pcommon.InstrumentationScope, dpsAttrs []pcommon.Map) ([]string, []error) {
+	keys := make([]string, len(dpsAttrs))
+	errs := make([]error, len(dpsAttrs))
+	for i, attrs := range dpsAttrs {
+		dpAttrs, err := MarshalAttributes(attrs)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		keys[i] = sumSeriesKey(metricName, resAttrs, scope, dpAttrs)
+	}
+
+	return keys, errs
+}
+
+// Returns the key of a series, attributes are JSON encoded with sorted keys
+func sumSeriesKey(metricName string, resAttrs []byte, scope pcommon.InstrumentationScope, dpAttrs []byte) string {
+	return strings.Join([]string{metricName, string(resAttrs), scope.Name(), scope.Version(), string(dpAttrs)}, "\x00")
+}
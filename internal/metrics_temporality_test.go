@@ -0,0 +1,212 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+)
+
+func newTestSum(temporality pmetric.AggregationTemporality, monotonic bool) pmetric.Sum {
+	sum := pmetric.NewSum()
+	sum.SetAggregationTemporality(temporality)
+	sum.SetIsMonotonic(monotonic)
+	return sum
+}
+
+func newTestSumDataPoint(sum pmetric.Sum, start, ts pcommon.Timestamp, value int64) pmetric.NumberDataPoint {
+	dp := sum.DataPoints().AppendEmpty()
+	dp.SetStartTimestamp(start)
+	dp.SetTimestamp(ts)
+	dp.SetIntValue(value)
+	return dp
+}
+
+type convertedSumDataPoint struct {
+	start pcommon.Timestamp
+	value float64
+}
+
+func convertSum(t *testing.T, c *sumConversion, sum pmetric.Sum, dp pmetric.NumberDataPoint) convertedSumDataPoint {
+	t.Helper()
+
+	start, value, err := c.convert("series", sum, dp)
+	require.NoError(t, err)
+	return convertedSumDataPoint{start: start, value: value}
+}
+
+// Starts a conversion of the "series" used by convertSum
+func beginSum(t *testing.T, n *SumNormalizer) *sumConversion {
+	t.Helper()
+
+	c, err := n.begin(context.Background(), []string{"series"})
+	require.NoError(t, err)
+	return c
+}
+
+func TestSumNormalizerDeltaToCumulative(t *testing.T) {
+	n := NewSumNormalizer(SumTemporalityCumulative)
+	sum := newTestSum(pmetric.AggregationTemporalityDelta, true)
+
+	c := beginSum(t, n)
+	assert.Equal(t, pmetric.AggregationTemporalityCumulative, c.temporality(sum))
+	assert.Equal(t, convertedSumDataPoint{start: 10, value: 2}, convertSum(t, c, sum, newTestSumDataPoint(sum, 10, 20, 2)))
+	assert.Equal(t, convertedSumDataPoint{start: 10, value: 5}, convertSum(t, c, sum, newTestSumDataPoint(sum, 20, 30, 3)))
+
+	_, _, err := c.convert("series", sum, newTestSumDataPoint(sum, 20, 30, 3))
+	assert.ErrorContains(t, err, "out of order")
+	c.end()
+
+	// Nothing was committed, so the same data points are converted the same way again
+	c = beginSum(t, n)
+	assert.Equal(t, convertedSumDataPoint{start: 10, value: 2}, convertSum(t, c, sum, newTestSumDataPoint(sum, 10, 20, 2)))
+	c.commit()
+	c.end()
+
+	c = beginSum(t, n)
+	assert.Equal(t, convertedSumDataPoint{start: 10, value: 6}, convertSum(t, c, sum, newTestSumDataPoint(sum, 20, 30, 4)))
+	c.end()
+}
+
+func TestSumNormalizerCumulativeToDelta(t *testing.T) {
+	n := NewSumNormalizer(SumTemporalityDelta)
+	sum := newTestSum(pmetric.AggregationTemporalityCumulative, true)
+
+	c := beginSum(t, n)
+	defer c.end()
+
+	assert.Equal(t, pmetric.AggregationTemporalityDelta, c.temporality(sum))
+	// The first data point covers everything since its start
+	assert.Equal(t, convertedSumDataPoint{start: 10, value: 10}, convertSum(t, c, sum, newTestSumDataPoint(sum, 10, 20, 10)))
+	assert.Equal(t, convertedSumDataPoint{start: 20, value: 5}, convertSum(t, c, sum, newTestSumDataPoint(sum, 10, 30, 15)))
+	// Restart with a new start timestamp
+	assert.Equal(t, convertedSumDataPoint{start: 35, value: 4}, convertSum(t, c, sum, newTestSumDataPoint(sum, 35, 40, 4)))
+	assert.Equal(t, convertedSumDataPoint{start: 40, value: 3}, convertSum(t, c, sum, newTestSumDataPoint(sum, 35, 50, 7)))
+	// Reset without a new start timestamp
+	assert.Equal(t, convertedSumDataPoint{start: 50, value: 2}, convertSum(t, c, sum, newTestSumDataPoint(sum, 35, 60, 2)))
+}
+
+func TestSumNormalizerCumulativeToDeltaWithoutStart(t *testing.T) {
+	n := NewSumNormalizer(SumTemporalityDelta)
+	sum := newTestSum(pmetric.AggregationTemporalityCumulative, false)
+
+	c := beginSum(t, n)
+	defer c.end()
+
+	_, _, err := c.convert("series", sum, newTestSumDataPoint(sum, 0, 20, 10))
+	assert.ErrorIs(t, err, errSumBaseline)
+	assert.Equal(t, convertedSumDataPoint{start: 20, value: 5}, convertSum(t, c, sum, newTestSumDataPoint(sum, 0, 30, 15)))
+	// Non-monotonic sums may go down
+	assert.Equal(t, convertedSumDataPoint{start: 30, value: -3}, convertSum(t, c, sum, newTestSumDataPoint(sum, 0, 40, 12)))
+}
+
+func TestSumNormalizerPassThrough(t *testing.T) {
+	var n *SumNormalizer
+	assert.Nil(t, NewSumNormalizer(SumTemporalityAsReceived))
+
+	sum := newTestSum(pmetric.AggregationTemporalityDelta, true)
+	c := beginSum(t, n)
+	assert.Equal(t, pmetric.AggregationTemporalityDelta, c.temporality(sum))
+	assert.Equal(t, convertedSumDataPoint{start: 10, value: 2}, convertSum(t, c, sum, newTestSumDataPoint(sum, 10, 20, 2)))
+	c.commit()
+	c.end()
+
+	// Sums already in the target temporality and sums without one are written as received
+	n = NewSumNormalizer(SumTemporalityDelta)
+	c = beginSum(t, n)
+	defer c.end()
+	assert.Equal(t, convertedSumDataPoint{start: 10, value: 2}, convertSum(t, c, sum, newTestSumDataPoint(sum, 10, 20, 2)))
+
+	unspecified := newTestSum(pmetric.AggregationTemporalityUnspecified, true)
+	assert.Equal(t, pmetric.AggregationTemporalityUnspecified, c.temporality(unspecified))
+	assert.Equal(t, convertedSumDataPoint{start: 10, value: 7}, convertSum(t, c, unspecified, newTestSumDataPoint(unspecified, 10, 20, 7)))
+}
+
+func TestSumNormalizerExpire(t *testing.T) {
+	n := NewSumNormalizer(SumTemporalityCumulative)
+	sum := newTestSum(pmetric.AggregationTemporalityDelta, true)
+
+	c := beginSum(t, n)
+	convertSum(t, c, sum, newTestSumDataPoint(sum, 10, 20, 2))
+	c.commit()
+	c.end()
+
+	n.Expire(time.Now())
+	assert.Len(t, n.series, 1)
+
+	n.Expire(time.Now().Add(sumSeriesTTL + time.Minute))
+	assert.Empty(t, n.series)
+}
+
+func TestSumSeriesKey(t *testing.T) {
+	scope := pcommon.NewInstrumentationScope()
+	scope.SetName("meter")
+
+	key := sumSeriesKey("requests", []byte(`{"service.name":"api"}`), scope, []byte(`{"code":200}`))
+	assert.Equal(t, key, sumSeriesKey("requests", []byte(`{"service.name":"api"}`), scope, []byte(`{"code":200}`)))
+	assert.NotEqual(t, key, sumSeriesKey("requests", []byte(`{"service.name":"api"}`), scope, []byte(`{"code":500}`)))
+	assert.NotEqual(t, key, sumSeriesKey("requests", []byte(`{"service.name":"web"}`), scope, []byte(`{"code":200}`)))
+}
+
+func TestSumNormalizerClaimsSeries(t *testing.T) {
+	n := NewSumNormalizer(SumTemporalityCumulative)
+	sum := newTestSum(pmetric.AggregationTemporalityDelta, true)
+	ctx := context.Background()
+
+	first, err := n.begin(ctx, []string{"series", "other", ""})
+	require.NoError(t, err)
+	convertSum(t, first, sum, newTestSumDataPoint(sum, 10, 20, 2))
+
+	// Other series aren't blocked by a conversion being written
+	unrelated, err := n.begin(ctx, []string{"unrelated"})
+	require.NoError(t, err)
+	unrelated.end()
+
+	// A conversion of the same series gives up with its context
+	canceled, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = n.begin(canceled, []string{"series"})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// and otherwise waits for the written state
+	second := make(chan convertedSumDataPoint)
+	go func() {
+		c, err := n.begin(ctx, []string{"series"})
+		if err != nil {
+			close(second)
+			return
+		}
+		defer c.end()
+
+		start, value, _ := c.convert("series", sum, newTestSumDataPoint(sum, 20, 30, 3))
+		second <- convertedSumDataPoint{start: start, value: value}
+	}()
+
+	select {
+	case <-second:
+		t.Fatal("conversion of a claimed series didn't wait")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	first.commit()
+	first.end()
+	assert.Equal(t, convertedSumDataPoint{start: 10, value: 5}, <-second)
+}
+
+func TestSumSeriesKeys(t *testing.T) {
+	scope := pcommon.NewInstrumentationScope()
+	ok, notFound := pcommon.NewMap(), pcommon.NewMap()
+	ok.PutInt("code", 200)
+	notFound.PutInt("code", 404)
+
+	keys, errs := sumSeriesKeys("requests", []byte(`{}`), scope, []pcommon.Map{ok, notFound})
+	assert.Equal(t, []string{
+		sumSeriesKey("requests", []byte(`{}`), scope, []byte(`{"code":200}`)),
+		sumSeriesKey("requests", []byte(`{}`), scope, []byte(`{"code":404}`)),
+	}, keys)
+	assert.Equal(t, []error{nil, nil}, errs)
+}
@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap"
+)
+
+const (
+	SchemaMigrationsTableName = "schema_migrations"
+
+	schemaMigrationsTableSQL = `
+	CREATE TABLE IF NOT EXISTS %s (
+		target      VARCHAR NOT NULL,
+		version     INTEGER NOT NULL,
+		description VARCHAR,
+		applied_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+
+		PRIMARY KEY (target, version)
+	)
+	`
+)
+
+// Migration is a versioned change of the database schema.
+// Up runs inside the transaction that records the migration as applied.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, tx *sql.Tx) error
+}
+
+// ExecMigration returns a migration step executing the given statements in order
+func ExecMigration(queries ...string) func(ctx context.Context, tx *sql.Tx) error {
+	return func(ctx context.Context, tx *sql.Tx) error {
+		for _, query := range queries {
+			if _, err := tx.ExecContext(ctx, query); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Migrate brings the objects of a migration target, e.g. a logs table, to the latest version.
+// Every target keeps its own version history in the schema_migrations table of the given schema.
+// Pending migrations are applied in version order in a single transaction that holds an advisory lock,
+// so collectors starting at the same time don't apply them twice.
+// It fails if the database was migrated by a newer version of the exporter.
+func Migrate(ctx context.Context, client *sql.DB, logger *zap.Logger, schemaName, target string, migrations []Migration) error {
+	migrationsTable := pgx.Identifier{schemaName, SchemaMigrationsTableName}.Sanitize()
+
+	tx, err := client.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("db.Begin: %w", err)
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, migrationsTable); err != nil {
+		return fmt.Errorf("failed acquiring migrations lock: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(schemaMigrationsTableSQL, migrationsTable)); err != nil {
+		return fmt.Errorf("failed creating schema migrations table: %w", err)
+	}
+
+	current, err := schemaVersion(ctx, tx, migrationsTable, target)
+	if err != nil {
+		return err
+	}
+
+	pending, err := pendingMigrations(current, migrations)
+	if err != nil {
+		return fmt.Errorf("%s: %w", target, err)
+	}
+
+	insert := fmt.Sprintf(`INSERT INTO %s (target, version, description) VALUES ($1, $2, $3)`, migrationsTable)
+	for _, m := range pending {
+		logger.Info("Applying schema migration",
+			zap.String("target", target), zap.Int("version", m.Version), zap.String("description", m.Description))
+
+		if err := m.Up(ctx, tx); err != nil {
+			return fmt.Errorf("failed applying migration %d (%s) of %s: %w", m.Version, m.Description, target, err)
+		}
+
+		if _, err := tx.ExecContext(ctx, insert, target, m.Version, m.Description); err != nil {
+			return fmt.Errorf("failed recording migration %d of %s: %w", m.Version, target, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// CheckSchemaVersion fails if the database was migrated by a newer version of the exporter, like Migrate,
+// without changing anything. It runs even when the exporter doesn't create the schema itself.
+func CheckSchemaVersion(ctx context.Context, client *sql.DB, schemaName, target string, migrations []Migration) error {
+	migrationsTable := pgx.Identifier{schemaName, SchemaMigrationsTableName}.Sanitize()
+
+	var exists bool
+	if err := client.QueryRowContext(ctx, `SELECT to_regclass($1) IS NOT NULL`, migrationsTable).Scan(&exists); err != nil {
+		return fmt.Errorf("failed looking up schema migrations table: %w", err)
+	}
+	if !exists {
+		return nil
+	}
+
+	current, err := schemaVersion(ctx, client, migrationsTable, target)
+	if err != nil {
+		return err
+	}
+
+	if _, err := pendingMigrations(current, migrations); err != nil {
+		return fmt.Errorf("%s: %w", target, err)
+	}
+
+	return nil
+}
+
+// Returns the latest applied version of a migration target, 0 if none was applied
+func schemaVersion(ctx context.Context, client sqlQuerier, migrationsTable, target string) (int, error) {
+	var current int
+	query := fmt.Sprintf(`SELECT COALESCE(MAX(version), 0) FROM %s WHERE target = $1`, migrationsTable)
+	if err := client.QueryRowContext(ctx, query, target).Scan(&current); err != nil {
+		return 0, fmt.Errorf("failed reading schema version of %s: %w", target, err)
+	}
+	return current, nil
+}
+
+// Returns the migrations newer than the current version ordered by version
+func pendingMigrations(current int, migrations []Migration) ([]Migration, error) {
+	sorted := slices.SortedFunc(slices.Values(migrations), func(a, b Migration) int {
+		return a.Version - b.Version
+	})
+
+	latest := 0
+	if len(sorted) > 0 {
+		latest = sorted[len(sorted)-1].Version
+	}
+
+	if current > latest {
+		return nil, fmt.Errorf("database schema is at version %d but this exporter only knows versions up to %d, upgrade the exporter", current, latest)
+	}
+
+	var pending []Migration
+	for _, m := range sorted {
+		if m.Version > current {
+			pending = append(pending, m)
+		}
+	}
+
+	return pending, nil
+}
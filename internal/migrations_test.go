@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestPendingMigrations(t *testing.T) {
+	migrations := []Migration{
+		{Version: 3, Description: "third"},
+		{Version: 1, Description: "first"},
+		{Version: 2, Description: "second"},
+	}
+
+	versions := func(ms []Migration) []int {
+		var result []int
+		for _, m := range ms {
+			result = append(result, m.Version)
+		}
+		return result
+	}
+
+	pending, err := pendingMigrations(0, migrations)
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 3}, versions(pending))
+
+	pending, err = pendingMigrations(2, migrations)
+	require.NoError(t, err)
+	assert.Equal(t, []int{3}, versions(pending))
+
+	pending, err = pendingMigrations(3, migrations)
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+
+	_, err = pendingMigrations(4, migrations)
+	assert.ErrorContains(t, err, "database schema is at version 4")
+}
+
+func TestCheckSchemaVersion(t *testing.T) {
+	client, schemaName := openTestSchema(t)
+	ctx := context.Background()
+
+	migrations := []Migration{
+		{Version: 1, Description: "first", Up: ExecMigration(`SELECT 1`)},
+		{Version: 2, Description: "second", Up: ExecMigration(`SELECT 1`)},
+	}
+
+	// Nothing to compare against in a schema that was never migrated
+	require.NoError(t, CheckSchemaVersion(ctx, client, schemaName+"_missing", "test/table", migrations))
+	require.NoError(t, CheckSchemaVersion(ctx, client, schemaName, "test/table", migrations))
+
+	require.NoError(t, Migrate(ctx, client, zap.NewNop(), schemaName, "test/table", migrations))
+	require.NoError(t, CheckSchemaVersion(ctx, client, schemaName, "test/table", migrations))
+
+	err := CheckSchemaVersion(ctx, client, schemaName, "test/table", migrations[:1])
+	assert.ErrorContains(t, err, "database schema is at version 2 but this exporter only knows versions up to 1")
+}
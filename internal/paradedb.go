@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+const (
+	bm25IndexSuffix = "_bm25_idx"
+
+	createPgSearchExtensionSQL = `CREATE EXTENSION IF NOT EXISTS pg_search`
+	createBM25IndexSQL         = `CREATE INDEX IF NOT EXISTS %s ON %s USING bm25 (%s) WITH (key_field = %s)`
+)
+
+// ParadeDBConfig defines the BM25 search index of the logs table. Only used with the 'paradedb' database type.
+type ParadeDBConfig struct {
+	// JSONB attribute columns indexed next to "Body", "SeverityText" and "ServiceName",
+	// their fields are searchable as e.g. "LogAttributes.http.method". Default - ["LogAttributes"]
+	IndexedAttributes []string `mapstructure:"indexed_attributes"`
+}
+
+// CreateBM25Index installs pg_search and creates a BM25 index over the columns of the table.
+// The key field must hold unique values. An existing index is left unchanged,
+// so it has to be dropped for new columns to be indexed.
+func CreateBM25Index(ctx context.Context, client *sql.DB, schemaName, tableName, keyField string, columns []string) error {
+	if _, err := client.ExecContext(ctx, createPgSearchExtensionSQL); err != nil {
+		return fmt.Errorf("failed creating pg_search extension: %w", err)
+	}
+
+	quoted := make([]string, 0, len(columns)+1)
+	quoted = append(quoted, QuoteIdentifier(keyField))
+	for _, column := range columns {
+		quoted = append(quoted, QuoteIdentifier(column))
+	}
+
+	query := fmt.Sprintf(createBM25IndexSQL,
+		QuoteIdentifier(boundedIdentifier(tableName, bm25IndexSuffix)), QuoteIdentifier(schemaName, tableName),
+		strings.Join(quoted, ", "), QuoteLiteral(keyField))
+	if _, err := client.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed creating BM25 index on %s: %w", tableName, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,283 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+type PartitionInterval string
+
+const (
+	PartitionIntervalNone   PartitionInterval = ""
+	PartitionIntervalHourly PartitionInterval = "hourly"
+	PartitionIntervalDaily  PartitionInterval = "daily"
+
+	// Postgres truncates longer identifiers
+	maxIdentifierLength = 63
+
+	partitionNameSeparator   = "_p"
+	defaultPartitionSuffix   = "_default"
+	hourlyPartitionTimestamp = "2006010215"
+	dailyPartitionTimestamp  = "20060102"
+
+	createPartitionSQL        = `CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM (%s) TO (%s)`
+	createDefaultPartitionSQL = `CREATE TABLE IF NOT EXISTS %s PARTITION OF %s DEFAULT`
+
+	attachDefaultPartitionSQL = `ALTER TABLE %s ATTACH PARTITION %s DEFAULT`
+	detachPartitionSQL        = `ALTER TABLE %s DETACH PARTITION %s`
+	movePartitionRowsSQL      = `WITH moved AS (DELETE FROM %s WHERE %s RETURNING *) INSERT INTO %s SELECT * FROM moved`
+
+	relationExistsSQL = `SELECT to_regclass($1) IS NOT NULL`
+
+	partitionKeySQL = `
+	SELECT a.attname
+	FROM pg_partitioned_table p
+	JOIN pg_attribute a ON a.attrelid = p.partrelid AND a.attnum = p.partattrs[0]
+	WHERE p.partrelid = to_regclass($1)
+	`
+
+	listPartitionsSQL = `
+	SELECT c.relname
+	FROM pg_inherits i
+	JOIN pg_class c ON c.oid = i.inhrelid
+	WHERE i.inhparent = to_regclass($1)
+	`
+)
+
+// PartitioningConfig defines how a table is partitioned by range of its timestamp column
+type PartitioningConfig struct {
+	// Partition interval. Can be 'hourly' or 'daily', empty disables partitioning.
+	// It only applies to tables created while it's set. Default - empty
+	Interval PartitionInterval `mapstructure:"interval"`
+	// Number of partitions created ahead of the current one. Default - 3
+	Premake int `mapstructure:"premake"`
+	// Detach expired partitions instead of dropping them, e.g. to archive them. Default - false
+	DetachExpired bool `mapstructure:"detach_expired"`
+}
+
+// Enabled reports whether new tables are created partitioned
+func (c PartitioningConfig) Enabled() bool {
+	return c.Interval != PartitionIntervalNone
+}
+
+func (i PartitionInterval) duration() time.Duration {
+	if i == PartitionIntervalHourly {
+		return time.Hour
+	}
+	return 24 * time.Hour
+}
+
+func (i PartitionInterval) layout() string {
+	if i == PartitionIntervalHourly {
+		return hourlyPartitionTimestamp
+	}
+	return dailyPartitionTimestamp
+}
+
+// Returns the start of the partition containing t
+func (i PartitionInterval) truncate(t time.Time) time.Time {
+	return t.UTC().Truncate(i.duration())
+}
+
+// RenderPartitionByClause returns the PARTITION BY clause for a table partitioned
+// on the given column, or an empty string when partitioning is disabled
+func RenderPartitionByClause(cfg PartitioningConfig, column string) string {
+	if !cfg.Enabled() {
+		return ""
+	}
+	return fmt.Sprintf("PARTITION BY RANGE (%s)", QuoteIdentifier(column))
+}
+
+// IsPartitioned reports whether the table exists and is a partitioned table. The client is a *sql.DB or a *sql.Tx.
+func IsPartitioned(ctx context.Context, client sqlQuerier, schemaName, tableName string) (bool, error) {
+	query := `SELECT EXISTS (SELECT 1 FROM pg_class WHERE oid = to_regclass($1) AND relkind = 'p')`
+
+	var partitioned bool
+	err := client.QueryRowContext(ctx, query, QuoteIdentifier(schemaName, tableName)).Scan(&partitioned)
+	if err != nil {
+		return false, err
+	}
+
+	return partitioned, nil
+}
+
+// MaintainPartitions creates the partition covering now and the configured number of upcoming ones,
+// plus a default partition catching rows outside of them.
+// Expired partitions are removed by EnforceRetention.
+func MaintainPartitions(ctx context.Context, client *sql.DB, schemaName, tableName string, cfg PartitioningConfig, now time.Time) error {
+	if !cfg.Enabled() {
+		return nil
+	}
+
+	parent := QuoteIdentifier(schemaName, tableName)
+	defaultPartition := QuoteIdentifier(schemaName, boundedIdentifier(tableName, defaultPartitionSuffix))
+	var errs error
+
+	_, err := client.ExecContext(ctx, fmt.Sprintf(createDefaultPartitionSQL, defaultPartition, parent))
+	if err != nil {
+		errs = errors.Join(errs, fmt.Errorf("failed creating default partition of %s: %w", parent, err))
+	}
+
+	start := cfg.Interval.truncate(now)
+	for n := 0; n <= cfg.Premake; n++ {
+		from := start.Add(time.Duration(n) * cfg.Interval.duration())
+		to := from.Add(cfg.Interval.duration())
+
+		partition := QuoteIdentifier(schemaName, partitionName(tableName, cfg.Interval, from))
+		if err := createPartition(ctx, client, parent, partition, defaultPartition, from, to); err != nil {
+			errs = errors.Join(errs, fmt.Errorf("failed creating partition of %s from %s: %w", parent, from, err))
+		}
+	}
+
+	return errs
+}
+
+// Creates a partition unless it exists. Postgres refuses to create a partition while the default partition
+// holds rows of its range, e.g. ones with clock skewed future timestamps, so the default partition is
+// detached while those rows are moved into the new partition and attached again, all in one transaction.
+func createPartition(ctx context.Context, client *sql.DB, parent, partition, defaultPartition string, from, to time.Time) error {
+	var exists bool
+	if err := client.QueryRowContext(ctx, relationExistsSQL, partition).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	tx, err := client.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	createSQL := fmt.Sprintf(createPartitionSQL, partition, parent, partitionBound(from), partitionBound(to))
+
+	var column string
+	if err := tx.QueryRowContext(ctx, partitionKeySQL, parent).Scan(&column); err != nil {
+		return fmt.Errorf("failed reading partition key: %w", err)
+	}
+	inRange := fmt.Sprintf("%[1]s >= %[2]s AND %[1]s < %[3]s", QuoteIdentifier(column), partitionBound(from), partitionBound(to))
+
+	var hasDefault, stray bool
+	if err := tx.QueryRowContext(ctx, relationExistsSQL, defaultPartition).Scan(&hasDefault); err != nil {
+		return err
+	}
+	if hasDefault {
+		query := fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE %s)", defaultPartition, inRange)
+		if err := tx.QueryRowContext(ctx, query).Scan(&stray); err != nil {
+			return fmt.Errorf("failed looking up rows of the range in the default partition: %w", err)
+		}
+	}
+
+	if !stray {
+		if _, err := tx.ExecContext(ctx, createSQL); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	err = ExecMigration(
+		fmt.Sprintf(detachPartitionSQL, parent, defaultPartition),
+		createSQL,
+		fmt.Sprintf(movePartitionRowsSQL, defaultPartition, inRange, partition),
+		fmt.Sprintf(attachDefaultPartitionSQL, parent, defaultPartition),
+	)(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Drops or detaches the partitions whose whole range is before the cutoff
+func dropExpiredPartitions(ctx context.Context, client *sql.DB, schemaName, tableName string, cfg PartitioningConfig, cutoff time.Time) error {
+	parent := QuoteIdentifier(schemaName, tableName)
+
+	rows, err := client.QueryContext(ctx, listPartitionsSQL, parent)
+	if err != nil {
+		return fmt.Errorf("failed listing partitions of %s: %w", parent, err)
+	}
+	defer rows.Close()
+
+	var expired []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+
+		from, ok := parsePartitionStart(name, cfg.Interval)
+		if ok && !from.Add(cfg.Interval.duration()).After(cutoff) {
+			expired = append(expired, name)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var errs error
+	for _, name := range expired {
+		query := fmt.Sprintf("DROP TABLE IF EXISTS %s", QuoteIdentifier(schemaName, name))
+		if cfg.DetachExpired {
+			query = fmt.Sprintf("ALTER TABLE %s DETACH PARTITION %s", parent, QuoteIdentifier(schemaName, name))
+		}
+
+		if _, err := client.ExecContext(ctx, query); err != nil {
+			errs = errors.Join(errs, fmt.Errorf("failed removing expired partition %s: %w", name, err))
+		}
+	}
+
+	return errs
+}
+
+// Partition names end with the start of their range, e.g. otellogs_p20250102 or otellogs_p2025010215
+func partitionName(tableName string, interval PartitionInterval, from time.Time) string {
+	return boundedIdentifier(tableName, partitionNameSeparator+from.UTC().Format(interval.layout()))
+}
+
+func parsePartitionStart(name string, interval PartitionInterval) (time.Time, bool) {
+	pos := strings.LastIndex(name, partitionNameSeparator)
+	if pos < 0 {
+		return time.Time{}, false
+	}
+
+	from, err := time.ParseInLocation(interval.layout(), name[pos+len(partitionNameSeparator):], time.UTC)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return from, true
+}
+
+// Partition bounds carry an explicit UTC offset, which is ignored by TIMESTAMP columns
+// and keeps TIMESTAMPTZ bounds independent of the session time zone
+func partitionBound(t time.Time) string {
+	return QuoteLiteral(t.UTC().Format("2006-01-02 15:04:05") + "+00")
+}
+
+// Appends the suffix to the name, shortening the name and adding a hash of it
+// if the result would be truncated by Postgres
+func boundedIdentifier(name, suffix string) string {
+	if len(name)+len(suffix) <= maxIdentifierLength {
+		return name + suffix
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name))
+	hash := fmt.Sprintf("_%08x", h.Sum32())
+
+	end := maxIdentifierLength - len(suffix) - len(hash)
+	for end > 0 && !utf8.RuneStart(name[end]) {
+		end--
+	}
+
+	return name[:end] + hash + suffix
+}
@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartitionName(t *testing.T) {
+	from := time.Date(2025, 1, 2, 15, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, "otellogs_p20250102", partitionName("otellogs", PartitionIntervalDaily, from))
+	assert.Equal(t, "otellogs_p2025010215", partitionName("otellogs", PartitionIntervalHourly, from))
+
+	start, ok := parsePartitionStart("otellogs_p20250102", PartitionIntervalDaily)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC), start)
+
+	_, ok = parsePartitionStart("otellogs_default", PartitionIntervalDaily)
+	assert.False(t, ok)
+}
+
+func TestPartitionNameLongTable(t *testing.T) {
+	from := time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC)
+	table := strings.Repeat("m", 70)
+
+	name := partitionName(table, PartitionIntervalHourly, from)
+	assert.LessOrEqual(t, len(name), maxIdentifierLength)
+	assert.True(t, strings.HasSuffix(name, "_p2025010200"))
+	assert.NotEqual(t, name, partitionName(strings.Repeat("m", 71), PartitionIntervalHourly, from))
+
+	start, ok := parsePartitionStart(name, PartitionIntervalHourly)
+	assert.True(t, ok)
+	assert.Equal(t, from, start)
+}
+
+func TestMaintainPartitionsMovesDefaultRows(t *testing.T) {
+	client, schemaName := openTestSchema(t)
+	ctx := context.Background()
+
+	table := QuoteIdentifier(schemaName, "otellogs")
+	_, err := client.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE %s ("Timestamp" TIMESTAMPTZ NOT NULL, "Body" TEXT) %s`,
+		table, RenderPartitionByClause(PartitioningConfig{Interval: PartitionIntervalDaily}, "Timestamp")))
+	require.NoError(t, err)
+
+	now := time.Date(2025, 1, 2, 12, 0, 0, 0, time.UTC)
+	cfg := PartitioningConfig{Interval: PartitionIntervalDaily, Premake: 0}
+	require.NoError(t, MaintainPartitions(ctx, client, schemaName, "otellogs", cfg, now))
+
+	// A clock skewed row two days ahead lands in the default partition
+	future := now.Add(48 * time.Hour)
+	_, err = client.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %s VALUES ($1, 'skewed')`, table), future)
+	require.NoError(t, err)
+
+	cfg.Premake = 3
+	require.NoError(t, MaintainPartitions(ctx, client, schemaName, "otellogs", cfg, now))
+
+	var partition string
+	err = client.QueryRowContext(ctx, fmt.Sprintf(`SELECT c.relname FROM %s t JOIN pg_class c ON c.oid = t.tableoid WHERE t."Body" = 'skewed'`, table)).Scan(&partition)
+	require.NoError(t, err)
+	assert.Equal(t, "otellogs_p20250104", partition)
+
+	// The default partition is attached again
+	_, err = client.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %s VALUES ($1, 'far')`, table), now.Add(365*24*time.Hour))
+	require.NoError(t, err)
+	err = client.QueryRowContext(ctx, fmt.Sprintf(`SELECT c.relname FROM %s t JOIN pg_class c ON c.oid = t.tableoid WHERE t."Body" = 'far'`, table)).Scan(&partition)
+	require.NoError(t, err)
+	assert.Equal(t, "otellogs_default", partition)
+}
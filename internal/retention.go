@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// Expired rows are deleted in batches, so no statement holds locks for long or bloats a single transaction
+	retentionDeleteBatchSize = 10000
+
+	// ctid alone is not unique across the partitions of a table or the chunks of a hypertable
+	deleteExpiredRowsSQL = `
+	DELETE FROM %[1]s WHERE (tableoid, ctid) IN (
+		SELECT tableoid, ctid FROM %[1]s WHERE %[2]s < $1 LIMIT %[3]d
+	)
+	`
+
+	timestampIndexSuffix = "_timestamp_idx"
+
+	hasTimestampIndexSQL = `
+	SELECT EXISTS (
+		SELECT 1
+		FROM pg_index i
+		JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = i.indkey[0]
+		WHERE i.indrelid = to_regclass($1) AND a.attname = $2
+	)
+	`
+	createTimestampIndexSQL = `CREATE INDEX IF NOT EXISTS %s ON %s (%s)`
+)
+
+// MetricTypeRetention overrides the retention of the metric tables of a type. Zero uses the metrics retention.
+type MetricTypeRetention struct {
+	Gauge                time.Duration `mapstructure:"gauge"`
+	Sum                  time.Duration `mapstructure:"sum"`
+	Histogram            time.Duration `mapstructure:"histogram"`
+	ExponentialHistogram time.Duration `mapstructure:"exponential_histogram"`
+	Summary              time.Duration `mapstructure:"summary"`
+}
+
+// EnforceRetention removes the rows of a table older than the retention. Zero retention keeps everything.
+//
+// On TimescaleDB a hypertable gets a retention policy, which drops expired chunks in the database itself.
+// Otherwise the partitions of a partitioned table that only hold expired rows are dropped or detached,
+// and the remaining expired rows are deleted in batches.
+func EnforceRetention(ctx context.Context, client *sql.DB, dbType DBType, schemaName, tableName, timestampColumn string, partitioning PartitioningConfig, retention time.Duration, now time.Time) error {
+	if retention <= 0 {
+		return nil
+	}
+
+	if dbType == DBTypeTimescaleDB {
+		hypertable, err := isHypertable(ctx, client, schemaName, tableName)
+		if err != nil {
+			return fmt.Errorf("failed checking if %s is a hypertable: %w", tableName, err)
+		}
+		if hypertable {
+			return ensurePolicy(ctx, client, schemaName, tableName, retentionPolicy, retention)
+		}
+	}
+
+	cutoff := now.Add(-retention).UTC()
+
+	var errs error
+	if partitioning.Enabled() {
+		partitioned, err := IsPartitioned(ctx, client, schemaName, tableName)
+		if err != nil {
+			return err
+		}
+		if partitioned {
+			errs = errors.Join(errs, dropExpiredPartitions(ctx, client, schemaName, tableName, partitioning, cutoff))
+		}
+	}
+
+	return errors.Join(errs, deleteExpiredRows(ctx, client, schemaName, tableName, timestampColumn, cutoff))
+}
+
+// EnsureTimestampIndex creates a btree index on the timestamp column of a plain table unless an index starts
+// with the column already. Without one, every batch of expired rows deleted by EnforceRetention scans the whole table.
+// Partitioned tables drop expired partitions instead and hypertables get a time index from TimescaleDB.
+func EnsureTimestampIndex(ctx context.Context, client *sql.DB, dbType DBType, schemaName, tableName, timestampColumn string) error {
+	if dbType == DBTypeTimescaleDB {
+		hypertable, err := isHypertable(ctx, client, schemaName, tableName)
+		if err != nil {
+			return fmt.Errorf("failed checking if %s is a hypertable: %w", tableName, err)
+		}
+		if hypertable {
+			return nil
+		}
+	}
+
+	partitioned, err := IsPartitioned(ctx, client, schemaName, tableName)
+	if err != nil {
+		return err
+	}
+	if partitioned {
+		return nil
+	}
+
+	table := QuoteIdentifier(schemaName, tableName)
+
+	var indexed bool
+	if err := client.QueryRowContext(ctx, hasTimestampIndexSQL, table, timestampColumn).Scan(&indexed); err != nil {
+		return fmt.Errorf("failed looking up timestamp index of %s: %w", tableName, err)
+	}
+	if indexed {
+		return nil
+	}
+
+	_, err = client.ExecContext(ctx, fmt.Sprintf(createTimestampIndexSQL,
+		QuoteIdentifier(boundedIdentifier(tableName, timestampIndexSuffix)), table, QuoteIdentifier(timestampColumn)))
+	if err != nil {
+		return fmt.Errorf("failed creating timestamp index of %s: %w", tableName, err)
+	}
+
+	return nil
+}
+
+func deleteExpiredRows(ctx context.Context, client *sql.DB, schemaName, tableName, timestampColumn string, cutoff time.Time) error {
+	query := fmt.Sprintf(deleteExpiredRowsSQL, QuoteIdentifier(schemaName, tableName), QuoteIdentifier(timestampColumn), retentionDeleteBatchSize)
+
+	for {
+		result, err := client.ExecContext(ctx, query, cutoff)
+		if err != nil {
+			return fmt.Errorf("failed deleting expired rows of %s: %w", tableName, err)
+		}
+
+		deleted, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if deleted < retentionDeleteBatchSize {
+			return nil
+		}
+	}
+}
+
+// Renders a duration as a Postgres interval input without losing precision
+func renderInterval(d time.Duration) string {
+	return fmt.Sprintf("%d microseconds", d.Microseconds())
+}
@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+)
+
+func TestRenderInterval(t *testing.T) {
+	assert.Equal(t, "2592000000000 microseconds", renderInterval(30*24*time.Hour))
+	assert.Equal(t, "1500000 microseconds", renderInterval(1500*time.Millisecond))
+}
+
+func TestMetricsRetentionByType(t *testing.T) {
+	settings := MetricsSettings{
+		Retention: 48 * time.Hour,
+		RetentionByType: MetricTypeRetention{
+			Histogram: 7 * 24 * time.Hour,
+		},
+	}
+
+	assert.Equal(t, 48*time.Hour, settings.retention(pmetric.MetricTypeGauge))
+	assert.Equal(t, 7*24*time.Hour, settings.retention(pmetric.MetricTypeHistogram))
+	assert.Equal(t, 48*time.Hour, settings.retention(pmetric.MetricTypeEmpty))
+	assert.True(t, settings.hasRetention())
+
+	assert.False(t, MetricsSettings{}.hasRetention())
+	assert.True(t, MetricsSettings{RetentionByType: MetricTypeRetention{Summary: time.Hour}}.hasRetention())
+}
+
+func TestEnsureTimestampIndex(t *testing.T) {
+	client, schemaName := openTestSchema(t)
+	ctx := context.Background()
+
+	countIndexes := func(tableName string) int {
+		var count int
+		query := `SELECT count(*) FROM pg_index WHERE indrelid = to_regclass($1)`
+		require.NoError(t, client.QueryRowContext(ctx, query, QuoteIdentifier(schemaName, tableName)).Scan(&count))
+		return count
+	}
+
+	_, err := client.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE %s ("Timestamp" TIMESTAMPTZ NOT NULL)`, QuoteIdentifier(schemaName, "otellogs")))
+	require.NoError(t, err)
+	require.NoError(t, EnsureTimestampIndex(ctx, client, DBTypePostgreSQL, schemaName, "otellogs", "Timestamp"))
+	require.NoError(t, EnsureTimestampIndex(ctx, client, DBTypePostgreSQL, schemaName, "otellogs", "Timestamp"))
+	assert.Equal(t, 1, countIndexes("otellogs"))
+
+	// Partitioned tables drop expired partitions instead
+	_, err = client.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE %s ("Timestamp" TIMESTAMPTZ NOT NULL) PARTITION BY RANGE ("Timestamp")`,
+		QuoteIdentifier(schemaName, "oteltraces")))
+	require.NoError(t, err)
+	require.NoError(t, EnsureTimestampIndex(ctx, client, DBTypePostgreSQL, schemaName, "oteltraces", "Timestamp"))
+	assert.Equal(t, 0, countIndexes("oteltraces"))
+}
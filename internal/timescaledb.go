@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	createHypertableSQL = `
+	SELECT create_hypertable(%s, by_range(%s, %s::interval), migrate_data => true, if_not_exists => true)
+	`
+	// Only applies to chunks created afterwards
+	setChunkTimeIntervalSQL = `SELECT set_chunk_time_interval(%s, %s::interval)`
+	enableCompressionSQL    = `ALTER TABLE %s SET (timescaledb.compress, timescaledb.compress_segmentby = %s)`
+
+	isHypertableSQL = `
+	SELECT EXISTS (
+		SELECT 1 FROM timescaledb_information.hypertables
+		WHERE hypertable_schema = $1 AND hypertable_name = $2
+	)
+	`
+	isCompressionEnabledSQL = `
+	SELECT compression_enabled FROM timescaledb_information.hypertables
+	WHERE hypertable_schema = $1 AND hypertable_name = $2
+	`
+
+	// Returns no rows if the hypertable has no such policy yet
+	policyMatchesSQL = `
+	SELECT (config->>%s)::interval = $3::interval
+	FROM timescaledb_information.jobs
+	WHERE proc_name = %s AND hypertable_schema = $1 AND hypertable_name = $2
+	`
+)
+
+// TimescaleDBConfig defines the hypertable of a logs or traces table. Only used with the 'timescaledb' database type.
+type TimescaleDBConfig struct {
+	// Time range covered by each chunk. Changes only apply to new chunks. Default - 24h
+	ChunkInterval time.Duration `mapstructure:"chunk_interval"`
+	// Chunks older than this are compressed, segmented by "ServiceName". Zero disables compression. Default - 168h
+	CompressAfter time.Duration `mapstructure:"compress_after"`
+}
+
+// A TimescaleDB background job attached to a hypertable
+type timescaleDBPolicy struct {
+	proc      string
+	configKey string
+	removeSQL string
+	addSQL    string
+}
+
+var (
+	retentionPolicy = timescaleDBPolicy{
+		proc:      "policy_retention",
+		configKey: "drop_after",
+		removeSQL: `SELECT remove_retention_policy(%s, if_exists => true)`,
+		addSQL:    `SELECT add_retention_policy(%s, drop_after => %s::interval, if_not_exists => true)`,
+	}
+
+	compressionPolicy = timescaleDBPolicy{
+		proc:      "policy_compression",
+		configKey: "compress_after",
+		removeSQL: `SELECT remove_compression_policy(%s, if_exists => true)`,
+		addSQL:    `SELECT add_compression_policy(%s, compress_after => %s::interval, if_not_exists => true)`,
+	}
+)
+
+// SetupHypertable turns the table into a hypertable on the time column and applies the chunk interval
+// and compression settings. It's idempotent, so it runs on every start to pick up changed settings.
+func SetupHypertable(ctx context.Context, client *sql.DB, schemaName, tableName, timeColumn, segmentByColumn string, cfg TimescaleDBConfig) error {
+	table := QuoteLiteral(QuoteIdentifier(schemaName, tableName))
+	chunkInterval := QuoteLiteral(renderInterval(cfg.ChunkInterval))
+
+	_, err := client.ExecContext(ctx, fmt.Sprintf(createHypertableSQL, table, QuoteLiteral(timeColumn), chunkInterval))
+	if err != nil {
+		return fmt.Errorf("failed creating hypertable %s: %w", tableName, err)
+	}
+
+	if _, err := client.ExecContext(ctx, fmt.Sprintf(setChunkTimeIntervalSQL, table, chunkInterval)); err != nil {
+		return fmt.Errorf("failed setting chunk interval of %s: %w", tableName, err)
+	}
+
+	if cfg.CompressAfter <= 0 {
+		return nil
+	}
+
+	// Compression settings can't be changed while compressed chunks exist, so they're only set once
+	var compressed bool
+	if err := client.QueryRowContext(ctx, isCompressionEnabledSQL, schemaName, tableName).Scan(&compressed); err != nil {
+		return fmt.Errorf("failed checking compression of %s: %w", tableName, err)
+	}
+	if !compressed {
+		query := fmt.Sprintf(enableCompressionSQL, QuoteIdentifier(schemaName, tableName), QuoteLiteral(QuoteIdentifier(segmentByColumn)))
+		if _, err := client.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("failed enabling compression of %s: %w", tableName, err)
+		}
+	}
+
+	return ensurePolicy(ctx, client, schemaName, tableName, compressionPolicy, cfg.CompressAfter)
+}
+
+func isHypertable(ctx context.Context, client *sql.DB, schemaName, tableName string) (bool, error) {
+	var hypertable bool
+	err := client.QueryRowContext(ctx, isHypertableSQL, schemaName, tableName).Scan(&hypertable)
+
+	return hypertable, err
+}
+
+// Adds the policy to the hypertable, replacing an existing one with a different interval
+func ensurePolicy(ctx context.Context, client *sql.DB, schemaName, tableName string, policy timescaleDBPolicy, after time.Duration) error {
+	interval := renderInterval(after)
+
+	var matches bool
+	query := fmt.Sprintf(policyMatchesSQL, QuoteLiteral(policy.configKey), QuoteLiteral(policy.proc))
+	err := client.QueryRowContext(ctx, query, schemaName, tableName, interval).Scan(&matches)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		return fmt.Errorf("failed reading %s of %s: %w", policy.proc, tableName, err)
+	case matches:
+		return nil
+	}
+
+	table := QuoteLiteral(QuoteIdentifier(schemaName, tableName))
+	if _, err := client.ExecContext(ctx, fmt.Sprintf(policy.removeSQL, table)); err != nil {
+		return fmt.Errorf("failed removing %s of %s: %w", policy.proc, tableName, err)
+	}
+	if _, err := client.ExecContext(ctx, fmt.Sprintf(policy.addSQL, table, QuoteLiteral(interval))); err != nil {
+		return fmt.Errorf("failed adding %s to %s: %w", policy.proc, tableName, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// Columns of the table among the given ones that still have the TIMESTAMP type
+	timestampColumnsSQL = `
+	SELECT attname FROM pg_attribute
+	WHERE attrelid = to_regclass($1) AND attname = ANY($2) AND NOT attisdropped AND atttypid = 'timestamp'::regtype
+	ORDER BY attnum
+	`
+
+	// The TimescaleDB catalog only exists where the extension is installed
+	hasTimescaleDBSQL = `SELECT to_regclass('timescaledb_information.hypertables') IS NOT NULL`
+
+	// The exporter writes UTC times, so values stored without time zone are read as UTC
+	alterTimestampColumnSQL = `ALTER COLUMN %[1]s TYPE TIMESTAMPTZ USING %[1]s AT TIME ZONE 'UTC'`
+)
+
+// ConvertTimestampColumns converts the TIMESTAMP columns among the given ones to TIMESTAMPTZ.
+// Columns that are TIMESTAMPTZ already or don't exist are left alone. The time column of partitioned tables
+// and hypertables can't be converted in place, so they're left unchanged with a warning.
+// The before and after statements run around the conversion, e.g. to drop and recreate objects depending
+// on the columns. They're skipped if nothing is converted.
+func ConvertTimestampColumns(ctx context.Context, tx *sql.Tx, logger *zap.Logger, schemaName, tableName string, columns, before, after []string) error {
+	table := QuoteIdentifier(schemaName, tableName)
+
+	convert, err := timestampColumns(ctx, tx, table, columns)
+	if err != nil {
+		return err
+	}
+	if len(convert) == 0 {
+		return nil
+	}
+
+	partitioned, err := isPartitionedOrHypertable(ctx, tx, schemaName, tableName)
+	if err != nil {
+		return err
+	}
+	if partitioned {
+		logger.Warn("Timestamp columns of partitioned tables and hypertables are not converted to TIMESTAMPTZ, convert them manually",
+			zap.String("table", table), zap.Strings("columns", convert))
+		return nil
+	}
+
+	actions := make([]string, 0, len(convert))
+	for _, column := range convert {
+		actions = append(actions, fmt.Sprintf(alterTimestampColumnSQL, QuoteIdentifier(column)))
+	}
+
+	queries := slices.Concat(before, []string{fmt.Sprintf("ALTER TABLE %s %s", table, strings.Join(actions, ", "))}, after)
+	for _, query := range queries {
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("failed converting timestamp columns of %s: %w", table, err)
+		}
+	}
+
+	return nil
+}
+
+func timestampColumns(ctx context.Context, tx *sql.Tx, table string, columns []string) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, timestampColumnsSQL, table, columns)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []string
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, err
+		}
+		result = append(result, column)
+	}
+
+	return result, rows.Err()
+}
+
+func isPartitionedOrHypertable(ctx context.Context, tx *sql.Tx, schemaName, tableName string) (bool, error) {
+	partitioned, err := IsPartitioned(ctx, tx, schemaName, tableName)
+	if err != nil || partitioned {
+		return partitioned, err
+	}
+
+	var timescaleDB bool
+	if err := tx.QueryRowContext(ctx, hasTimescaleDBSQL).Scan(&timescaleDB); err != nil {
+		return false, err
+	}
+	if !timescaleDB {
+		return false, nil
+	}
+
+	var hypertable bool
+	err = tx.QueryRowContext(ctx, isHypertableSQL, schemaName, tableName).Scan(&hypertable)
+
+	return hypertable, err
+}
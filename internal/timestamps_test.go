@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/destrex271/postgresexporter/internal/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestConvertTimestampColumns(t *testing.T) {
+	client, schemaName := openTestSchema(t)
+	ctx := context.Background()
+
+	timestamp := time.Date(2025, 1, 2, 3, 4, 5, 123456000, time.UTC)
+	plain := QuoteIdentifier(schemaName, "plain")
+	partitioned := QuoteIdentifier(schemaName, "partitioned")
+	for _, query := range []string{
+		fmt.Sprintf(`CREATE TABLE %s (start_timestamp TIMESTAMP, timestamp TIMESTAMP NOT NULL)`, plain),
+		fmt.Sprintf(`CREATE TABLE %s (timestamp TIMESTAMP NOT NULL) PARTITION BY RANGE (timestamp)`, partitioned),
+	} {
+		_, err := client.ExecContext(ctx, query)
+		require.NoError(t, err)
+	}
+	_, err := client.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %s VALUES ($1, $1)`, plain), timestamp)
+	require.NoError(t, err)
+
+	convert := func() {
+		err := db.DoWithTx(ctx, client, func(tx *sql.Tx) error {
+			if err := ConvertTimestampColumns(ctx, tx, zap.NewNop(), schemaName, "plain", []string{"start_timestamp", "timestamp", "missing"}, nil, nil); err != nil {
+				return err
+			}
+			return ConvertTimestampColumns(ctx, tx, zap.NewNop(), schemaName, "partitioned", []string{"timestamp"}, nil, nil)
+		})
+		require.NoError(t, err)
+	}
+
+	convert()
+	// Converting again finds nothing to do
+	convert()
+
+	columnType := func(table string) string {
+		var result string
+		query := `SELECT format_type(atttypid, atttypmod) FROM pg_attribute WHERE attrelid = to_regclass($1) AND attname = 'timestamp'`
+		require.NoError(t, client.QueryRowContext(ctx, query, table).Scan(&result))
+		return result
+	}
+	assert.Equal(t, "timestamp with time zone", columnType(plain))
+	assert.Equal(t, "timestamp without time zone", columnType(partitioned))
+
+	var got time.Time
+	require.NoError(t, client.QueryRowContext(ctx, fmt.Sprintf(`SELECT timestamp FROM %s`, plain)).Scan(&got))
+	assert.True(t, timestamp.Equal(got), "got %s", got)
+}
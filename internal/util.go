@@ -3,21 +3,48 @@ package internal
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
 
+	"github.com/jackc/pgx/v5"
+	"go.opentelemetry.io/collector/pdata/pcommon"
 	"go.uber.org/zap"
 )
 
 type DBType string
 
+// ConflictAction defines what happens when an inserted row violates the primary key
+type ConflictAction string
+
 const (
 	DBTypePostgreSQL  DBType = "postgresql"
 	DBTypeTimescaleDB DBType = "timescaledb"
 	DBTypeParadeDB    DBType = "paradedb"
 
-	createTableIfNotExistsSQL = `CREATE TABLE IF NOT EXISTS "%s"."%s" (%s)`
+	// Fail the batch when a row collides with an existing primary key
+	ConflictActionError ConflictAction = "error"
+	// Skip rows that collide with an existing primary key
+	ConflictActionDoNothing ConflictAction = "do_nothing"
+	// Overwrite the existing row with the colliding one
+	ConflictActionUpdate ConflictAction = "update"
+
+	createTableIfNotExistsSQL = `CREATE TABLE IF NOT EXISTS %s (%s)`
 )
 
+// Implemented by *sql.DB and *sql.Tx
+type sqlExecutor interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// Implemented by *sql.DB and *sql.Tx
+type sqlQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
 var logger *zap.Logger
 
 func SetLogger(l *zap.Logger) {
@@ -36,12 +63,141 @@ func CheckIfTableExists(ctx context.Context, client *sql.DB, schemaName string,
 	return exists, nil
 }
 
+// FindLegacyTable returns the schema of a table that an unqualified name resolves to through the search_path
+// while no table of that name exists in schemaName, e.g. one created before the exporter qualified its tables.
+// An empty string is returned otherwise.
+func FindLegacyTable(ctx context.Context, client sqlQuerier, schemaName string, tableName string) (string, error) {
+	query := `
+	SELECT COALESCE((
+		SELECT n.nspname
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.oid = to_regclass(quote_ident($2)) AND n.nspname <> $1
+			AND to_regclass(quote_ident($1) || '.' || quote_ident($2)) IS NULL
+	), '')
+	`
+
+	var legacySchema string
+	if err := client.QueryRowContext(ctx, query, schemaName, tableName).Scan(&legacySchema); err != nil {
+		return "", err
+	}
+
+	return legacySchema, nil
+}
+
+// GetPrimaryKey returns the name and the ordered columns of the table primary key.
+// The table name may be schema qualified and must be quoted where needed.
+// An empty name is returned if the table doesn't exist or has no primary key.
+func GetPrimaryKey(ctx context.Context, tx *sql.Tx, table string) (string, []string, error) {
+	query := `
+	SELECT c.conname, a.attname
+	FROM pg_constraint c
+	JOIN pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = ANY(c.conkey)
+	WHERE c.conrelid = to_regclass($1) AND c.contype = 'p'
+	ORDER BY array_position(c.conkey, a.attnum)
+	`
+
+	rows, err := tx.QueryContext(ctx, query, table)
+	if err != nil {
+		return "", nil, err
+	}
+	defer rows.Close()
+
+	var name string
+	var columns []string
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&name, &column); err != nil {
+			return "", nil, err
+		}
+		columns = append(columns, column)
+	}
+
+	return name, columns, rows.Err()
+}
+
+// RenderOnConflictClause renders the ON CONFLICT clause for the given action.
+// On update every column outside of the key is overwritten with the new value.
+func RenderOnConflictClause(action ConflictAction, keyColumns, columns []string) string {
+	quotedKey := make([]string, len(keyColumns))
+	for i, column := range keyColumns {
+		quotedKey[i] = QuoteIdentifier(column)
+	}
+
+	switch action {
+	case ConflictActionDoNothing:
+		return fmt.Sprintf("ON CONFLICT (%s) DO NOTHING", strings.Join(quotedKey, ", "))
+	case ConflictActionUpdate:
+		var updates []string
+		for _, column := range columns {
+			if slices.Contains(keyColumns, column) {
+				continue
+			}
+			quoted := QuoteIdentifier(column)
+			updates = append(updates, fmt.Sprintf("%s = EXCLUDED.%s", quoted, quoted))
+		}
+		return fmt.Sprintf("ON CONFLICT (%s) DO UPDATE SET %s", strings.Join(quotedKey, ", "), strings.Join(updates, ", "))
+	default:
+		return ""
+	}
+}
+
 func CreateSchema(ctx context.Context, client *sql.DB, schemaName string) error {
 	query := `CREATE SCHEMA IF NOT EXISTS %s`
-	_, err := client.ExecContext(ctx, fmt.Sprintf(query, schemaName))
+	_, err := client.ExecContext(ctx, fmt.Sprintf(query, QuoteIdentifier(schemaName)))
 	if err != nil {
 		return fmt.Errorf("failed creating schema: %w", err)
 	}
 
 	return nil
 }
+
+// QuoteIdentifier quotes a possibly schema qualified name for use in SQL,
+// e.g. QuoteIdentifier("otel", "http.server.duration") returns "otel"."http.server.duration"
+func QuoteIdentifier(parts ...string) string {
+	return pgx.Identifier(parts).Sanitize()
+}
+
+// QuoteLiteral quotes a string as an SQL string literal
+func QuoteLiteral(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// RenderInsertSQL renders a parameterized INSERT statement for the given columns.
+// The table name is used as is, so it must already be quoted.
+func RenderInsertSQL(table string, columns []string) string {
+	quoted := make([]string, len(columns))
+	params := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = QuoteIdentifier(column)
+		params[i] = fmt.Sprintf("$%d", i+1)
+	}
+
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table, strings.Join(quoted, ", "), strings.Join(params, ", "))
+}
+
+// MarshalAttributes encodes attributes as a JSON object that keeps the value types,
+// so ints, bools, doubles, slices and nested maps stay usable with JSONB operators.
+// Non-finite doubles have no JSON representation and are encoded as strings ("NaN", "+Inf", "-Inf").
+func MarshalAttributes(attrs pcommon.Map) ([]byte, error) {
+	return json.Marshal(sanitizeJSONValue(attrs.AsRaw()))
+}
+
+func sanitizeJSONValue(value any) any {
+	switch v := value.(type) {
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return strconv.FormatFloat(v, 'g', -1, 64)
+		}
+	case map[string]any:
+		for k, e := range v {
+			v[k] = sanitizeJSONValue(e)
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = sanitizeJSONValue(e)
+		}
+	}
+
+	return value
+}
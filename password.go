@@ -0,0 +1,39 @@
+package postgresexporter
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/destrex271/postgresexporter/internal/db"
+	"go.opentelemetry.io/collector/component"
+)
+
+// PasswordProvider is implemented by extensions handing out database passwords, e.g. short-lived auth tokens
+// of a cloud provider. The exporter asks the extension set as database.password_provider for the password
+// whenever it opens a connection.
+type PasswordProvider interface {
+	Password(ctx context.Context) (string, error)
+}
+
+// Returns how the password of new connections is obtained, or nil to use the configured one
+func (dbcfg DatabaseConfig) passwordFunc(host component.Host) (db.PasswordFunc, error) {
+	switch {
+	case dbcfg.PasswordFile != "":
+		return db.FilePassword(dbcfg.PasswordFile), nil
+
+	case dbcfg.PasswordProvider != nil:
+		extension, present := host.GetExtensions()[*dbcfg.PasswordProvider]
+		if !present {
+			return nil, fmt.Errorf("password provider extension %q not found", dbcfg.PasswordProvider.String())
+		}
+
+		provider, ok := extension.(PasswordProvider)
+		if !ok {
+			return nil, fmt.Errorf("extension %q is not a password provider", dbcfg.PasswordProvider.String())
+		}
+
+		return provider.Password, nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,58 @@
+package postgresexporter
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/component"
+)
+
+type tokenProvider struct {
+	component.StartFunc
+	component.ShutdownFunc
+}
+
+func (tokenProvider) Password(_ context.Context) (string, error) {
+	return "token", nil
+}
+
+type nopExtension struct {
+	component.StartFunc
+	component.ShutdownFunc
+}
+
+type extensionsHost struct {
+	extensions map[component.ID]component.Component
+}
+
+func (h extensionsHost) GetExtensions() map[component.ID]component.Component {
+	return h.extensions
+}
+
+func TestPasswordFunc(t *testing.T) {
+	tokens := component.MustNewID("tokens")
+	other := component.MustNewID("other")
+	host := extensionsHost{extensions: map[component.ID]component.Component{
+		tokens: tokenProvider{},
+		other:  nopExtension{},
+	}}
+
+	password, err := DatabaseConfig{}.passwordFunc(host)
+	require.NoError(t, err)
+	assert.Nil(t, password)
+
+	password, err = DatabaseConfig{PasswordProvider: &tokens}.passwordFunc(host)
+	require.NoError(t, err)
+	p, err := password(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "token", p)
+
+	_, err = DatabaseConfig{PasswordProvider: &other}.passwordFunc(host)
+	assert.ErrorContains(t, err, `extension "other" is not a password provider`)
+
+	missing := component.MustNewID("missing")
+	_, err = DatabaseConfig{PasswordProvider: &missing}.passwordFunc(host)
+	assert.ErrorContains(t, err, `password provider extension "missing" not found`)
+}
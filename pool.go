@@ -0,0 +1,70 @@
+package postgresexporter
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+
+	"go.opentelemetry.io/collector/component"
+)
+
+// The logs, traces and metrics exporters of one component instance are created with the same config,
+// so they share the connection pool opened for it
+var pools = newPoolRegistry(func(ctx context.Context, cfg *Config, host component.Host) (*sql.DB, error) {
+	return cfg.buildDB(ctx, host)
+})
+
+type sharedPool struct {
+	client *sql.DB
+	refs   int
+}
+
+// poolRegistry hands out one connection pool per config and closes it when the last exporter releases it
+type poolRegistry struct {
+	open func(ctx context.Context, cfg *Config, host component.Host) (*sql.DB, error)
+
+	mu    sync.Mutex
+	pools map[*Config]*sharedPool
+}
+
+func newPoolRegistry(open func(ctx context.Context, cfg *Config, host component.Host) (*sql.DB, error)) *poolRegistry {
+	return &poolRegistry{open: open, pools: map[*Config]*sharedPool{}}
+}
+
+// Returns the pool of the config, opening it if it's the first exporter asking for it
+func (r *poolRegistry) acquire(ctx context.Context, cfg *Config, host component.Host) (*sql.DB, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if pool, present := r.pools[cfg]; present {
+		pool.refs++
+		return pool.client, nil
+	}
+
+	client, err := r.open(ctx, cfg, host)
+	if err != nil {
+		return nil, err
+	}
+
+	r.pools[cfg] = &sharedPool{client: client, refs: 1}
+	return client, nil
+}
+
+// Gives up a pool returned by acquire, the last release closes it
+func (r *poolRegistry) release(cfg *Config) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	pool, present := r.pools[cfg]
+	if !present {
+		return nil
+	}
+
+	pool.refs--
+	if pool.refs > 0 {
+		return nil
+	}
+
+	delete(r.pools, cfg)
+	return pool.client.Close()
+}
@@ -0,0 +1,48 @@
+package postgresexporter
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/destrex271/postgresexporter/internal/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/component"
+	"go.opentelemetry.io/collector/component/componenttest"
+)
+
+func TestPoolRegistry(t *testing.T) {
+	ctx := context.Background()
+
+	opened := 0
+	registry := newPoolRegistry(func(_ context.Context, cfg *Config, _ component.Host) (*sql.DB, error) {
+		opened++
+		return db.Open(cfg.DatabaseConfig.connString(), cfg.DatabaseConfig.TLS, nil)
+	})
+
+	cfg := createDefaultConfig().(*Config)
+	logs, err := registry.acquire(ctx, cfg, componenttest.NewNopHost())
+	require.NoError(t, err)
+	metrics, err := registry.acquire(ctx, cfg, componenttest.NewNopHost())
+	require.NoError(t, err)
+	assert.Same(t, logs, metrics)
+
+	otherCfg := createDefaultConfig().(*Config)
+	other, err := registry.acquire(ctx, otherCfg, componenttest.NewNopHost())
+	require.NoError(t, err)
+	assert.NotSame(t, logs, other)
+	assert.Equal(t, 2, opened)
+
+	require.NoError(t, registry.release(cfg))
+	assert.Equal(t, 1, registry.pools[cfg].refs)
+
+	// The last release closes the pool, which isn't reused
+	require.NoError(t, registry.release(cfg))
+	assert.ErrorContains(t, logs.PingContext(ctx), "database is closed")
+	assert.Len(t, registry.pools, 1)
+	require.NoError(t, registry.release(cfg))
+
+	require.NoError(t, registry.release(otherCfg))
+	assert.Empty(t, registry.pools)
+}